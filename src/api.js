@@ -190,6 +190,7 @@ router.get('/config/structured', (req, res) => {
         invert_matchers: Boolean(l.invert_matchers),
         terminateTls: Boolean(l.terminateTls),
         starttls: Boolean(l.starttls),
+        starttls_check_upstreams: Boolean(l.starttls_check_upstreams),
         acme: Boolean(l.acme),
         fromDomain: toStringArray(parseJSON(l.fromDomain)),
         toDomain: toStringArray(parseJSON(l.toDomain)),
@@ -339,7 +340,7 @@ const insertHeaderStmt = db.prepare(`
 
 const deleteLayer4Stmt = db.prepare('DELETE FROM layer4');
 const insertLayer4Stmt = db.prepare(`
-  INSERT INTO layer4 (id, enabled, sequence, type, protocol, fromDomain, fromPort, matchers, invert_matchers, toDomain, toPort, terminateTls, proxyProtocol, description, originate_tls, remote_ip, lb_policy, passive_health_fail_duration, passive_health_max_fails, starttls, default_sni, upstream_tls_server_name, acme, customCert)
+  INSERT INTO layer4 (id, enabled, sequence, type, protocol, fromDomain, fromPort, matchers, invert_matchers, toDomain, toPort, terminateTls, proxyProtocol, description, originate_tls, remote_ip, lb_policy, passive_health_fail_duration, passive_health_max_fails, starttls, starttls_check_upstreams, default_sni, upstream_tls_server_name, acme, customCert)
   SELECT
     json_extract(value, '$.id'),
     json_extract(value, '$.enabled'),
@@ -361,6 +362,7 @@ const insertLayer4Stmt = db.prepare(`
     json_extract(value, '$.passive_health_fail_duration'),
     json_extract(value, '$.passive_health_max_fails'),
     json_extract(value, '$.starttls'),
+    json_extract(value, '$.starttls_check_upstreams'),
     json_extract(value, '$.default_sni'),
     json_extract(value, '$.upstream_tls_server_name'),
     json_extract(value, '$.acme'),
@@ -423,6 +425,7 @@ router.post('/config/structured', express.json(), async (req, res) => {
       terminateTls: l.terminateTls ? 1 : 0,
       remote_ip: JSON.stringify(toStringArray(l.remote_ip)),
       starttls: l.starttls ? 1 : 0,
+      starttls_check_upstreams: l.starttls_check_upstreams ? 1 : 0,
       acme: l.acme ? 1 : 0
     }));
 
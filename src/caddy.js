@@ -240,7 +240,15 @@ function generateCaddyfile(config, certsDir = './certs') {
 
       // Handlers run in definition order inside the selected layer4 route.
       if (l4.starttls) {
-        sb += `${indent}starttls\n`;
+        const checkUpstreams = l4.starttls_check_upstreams ? (l4.toDomain || []).map((to) => layer4UpstreamAddress(l4, to)) : [];
+        if (checkUpstreams.length > 0) {
+          // Answer STARTTLS with 454 instead of handshaking while no upstream is reachable.
+          sb += `${indent}starttls {\n`;
+          sb += `${indent}\tcheck_upstream ${checkUpstreams.join(' ')}\n`;
+          sb += `${indent}}\n`;
+        } else {
+          sb += `${indent}starttls\n`;
+        }
       }
 
       if (l4.terminateTls || l4.starttls) {
@@ -149,6 +149,7 @@ const SCHEMA_SQL = `
       passive_health_fail_duration TEXT,
       passive_health_max_fails TEXT,
       starttls INTEGER DEFAULT 0,
+      starttls_check_upstreams INTEGER DEFAULT 0,
       default_sni TEXT,
       upstream_tls_server_name TEXT,
       acme INTEGER DEFAULT 0,
@@ -231,6 +232,7 @@ function runMigrations() {
     { table: 'layer4', column: 'passive_health_max_fails', def: 'TEXT' },
     { table: 'layer4', column: 'invert_matchers', def: 'INTEGER DEFAULT 0' },
     { table: 'layer4', column: 'starttls', def: 'INTEGER DEFAULT 0' },
+    { table: 'layer4', column: 'starttls_check_upstreams', def: 'INTEGER DEFAULT 0' },
     { table: 'layer4', column: 'default_sni', def: 'TEXT' },
     { table: 'layer4', column: 'upstream_tls_server_name', def: 'TEXT' },
     { table: 'layer4', column: 'acme', def: 'INTEGER DEFAULT 0' },
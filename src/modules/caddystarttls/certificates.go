@@ -0,0 +1,290 @@
+package caddystarttls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/ocsp"
+)
+
+// defaultReloadInterval is how often certificate files are checked for changes.
+const defaultReloadInterval = caddy.Duration(time.Minute)
+
+// certFile is a certificate and key pair loaded from disk, either from PEM
+// files or from a PKCS#12 bundle. It is checked for changes periodically and
+// the served certificate is replaced atomically once a valid new pair has
+// been found.
+type certFile struct {
+	certPath string
+	keyPath  string // empty for PKCS#12 bundles, which are read from certPath
+	password string // for an encrypted key or PKCS#12 bundle
+	pkcs12   bool
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// Only touched by the initial load and the watcher goroutine.
+	certModTime time.Time
+	keyModTime  time.Time
+	hash        [sha256.Size]byte
+	ocspResp    *ocsp.Response
+	// refused is set when the certificate must not be served, e.g. because
+	// it has been revoked.
+	refused bool
+	// expired is set for a cert_dir certificate that has expired and is not
+	// served, see CustomTLS.excludeExpiredDirPairs.
+	expired bool
+	// expiryLevel is the last expiry warning level logged for cert.
+	expiryLevel int
+}
+
+// load reads the pair if either file changed since the last call. It reports
+// whether a new certificate was stored. If the new files do not form a valid
+// pair the previous certificate stays in place and an error is returned;
+// the same content is not reported again until it changes.
+func (f *certFile) load() (bool, error) {
+	certInfo, err := os.Stat(f.certPath)
+	if err != nil {
+		return false, err
+	}
+	var keyModTime time.Time
+	if f.keyPath != "" {
+		keyInfo, err := os.Stat(f.keyPath)
+		if err != nil {
+			return false, err
+		}
+		keyModTime = keyInfo.ModTime()
+	}
+	if f.cert.Load() != nil && certInfo.ModTime().Equal(f.certModTime) && keyModTime.Equal(f.keyModTime) {
+		return false, nil
+	}
+
+	certData, err := os.ReadFile(f.certPath)
+	if err != nil {
+		return false, err
+	}
+	var keyData []byte
+	if f.keyPath != "" {
+		if keyData, err = os.ReadFile(f.keyPath); err != nil {
+			return false, err
+		}
+	}
+	f.certModTime, f.keyModTime = certInfo.ModTime(), keyModTime
+
+	h := sha256.New()
+	h.Write(certData)
+	h.Write(keyData)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	if sum == f.hash {
+		// Touched but not changed, or the same bad content as last time.
+		return false, nil
+	}
+	f.hash = sum
+
+	var cert tls.Certificate
+	if f.pkcs12 {
+		cert, err = parsePKCS12(certData, f.password)
+		if err != nil {
+			return false, fmt.Errorf("loading PKCS#12 file %s: %w", f.certPath, err)
+		}
+	} else {
+		cert, err = parseKeyPair(certData, keyData, f.password)
+		if err != nil {
+			return false, fmt.Errorf("loading key pair %s, %s: %w", f.certPath, f.keyPath, err)
+		}
+	}
+	f.cert.Store(&cert)
+	f.expiryLevel = 0
+	return true, nil
+}
+
+// CertKeyPair is a certificate file and the file holding its private key.
+type CertKeyPair struct {
+	CertPath string `json:"cert_path,omitempty"`
+	KeyPath  string `json:"key_path,omitempty"`
+
+	// Password of an encrypted key. Defaults to the handler's key_password.
+	KeyPassword string `json:"key_password,omitempty"`
+}
+
+// certSet holds the certificates a handler serves and selects one by SNI.
+// Explicit pairs come first and the first certificate loaded is served when
+// no name matches. A directory is scanned for <name>.pem files with a
+// matching <name>.key, the layout LocalCaddyHub writes its certs in.
+type certSet struct {
+	pairs       []*certFile
+	dir         string
+	dirPassword string
+
+	// Only touched by the initial load and the watcher goroutine.
+	dirPairs map[string]*certFile
+
+	index atomic.Pointer[certIndex]
+}
+
+// certIndex maps lowercase DNS names, including wildcard names such as
+// "*.example.com", to the pair whose certificate covers them.
+type certIndex struct {
+	names    map[string]*certFile
+	fallback *certFile
+}
+
+// newCertSet creates a set of the given pairs and the pairs found in dir,
+// whose keys are decrypted with dirPassword if they are encrypted.
+func newCertSet(pairs []*certFile, dir, dirPassword string) *certSet {
+	return &certSet{pairs: pairs, dir: dir, dirPassword: dirPassword, dirPairs: make(map[string]*certFile)}
+}
+
+// reload loads all pairs that changed, picks up certificates added to or
+// removed from the directory and rebuilds the name index. Pairs that fail
+// to load keep serving their previous certificate, if any.
+func (s *certSet) reload() (reloaded []*certFile, errs []error) {
+	rescanned := false
+	if s.dir != "" {
+		var err error
+		if rescanned, err = s.scanDir(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	files := s.files()
+	for _, f := range files {
+		changed, err := f.load()
+		if err != nil {
+			if s.dirPairs[f.certPath] == f {
+				err = dirPairError{err}
+			}
+			errs = append(errs, err)
+		}
+		if changed {
+			reloaded = append(reloaded, f)
+		}
+	}
+
+	if len(reloaded) > 0 || rescanned || s.index.Load() == nil {
+		s.buildIndex(files)
+	}
+	return reloaded, errs
+}
+
+// dirPairError is an error loading a pair found in the directory. The
+// directory holds arbitrary uploads, so such a pair is skipped rather than
+// failing the whole handler.
+type dirPairError struct{ error }
+
+func (e dirPairError) Unwrap() error { return e.error }
+
+// rebuild updates the name index after a pair was refused or allowed again.
+func (s *certSet) rebuild() {
+	s.buildIndex(s.files())
+}
+
+// files returns the explicit pairs followed by the directory pairs sorted by path.
+func (s *certSet) files() []*certFile {
+	paths := make([]string, 0, len(s.dirPairs))
+	for path := range s.dirPairs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	files := append([]*certFile(nil), s.pairs...)
+	for _, path := range paths {
+		files = append(files, s.dirPairs[path])
+	}
+	return files
+}
+
+// scanDir updates the directory pairs and reports whether any were added or removed.
+func (s *certSet) scanDir() (bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return false, fmt.Errorf("reading cert_dir: %w", err)
+	}
+
+	found := make(map[string]bool)
+	changed := false
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+		certPath := filepath.Join(s.dir, e.Name())
+		keyPath := strings.TrimSuffix(certPath, ".pem") + ".key"
+		if _, err := os.Stat(keyPath); err != nil {
+			// Not a certificate we can serve, e.g. a CA bundle.
+			continue
+		}
+		found[certPath] = true
+		if _, ok := s.dirPairs[certPath]; !ok {
+			s.dirPairs[certPath] = &certFile{certPath: certPath, keyPath: keyPath, password: s.dirPassword}
+			changed = true
+		}
+	}
+	for path := range s.dirPairs {
+		if !found[path] {
+			delete(s.dirPairs, path)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func (s *certSet) buildIndex(files []*certFile) {
+	idx := &certIndex{names: make(map[string]*certFile)}
+	for _, f := range files {
+		cert := f.cert.Load()
+		if cert == nil || f.refused || f.expired {
+			continue
+		}
+		if idx.fallback == nil {
+			idx.fallback = f
+		}
+		if cert.Leaf == nil {
+			continue
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// Earlier certificates take precedence for a name.
+			if _, ok := idx.names[name]; !ok {
+				idx.names[name] = f
+			}
+		}
+	}
+	s.index.Store(idx)
+}
+
+// certificate returns the certificate for serverName: an exact SAN match,
+// then a wildcard match for the first label, then the fallback.
+func (s *certSet) certificate(serverName string) *tls.Certificate {
+	idx := s.index.Load()
+	if idx == nil {
+		return nil
+	}
+	f := idx.fallback
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name != "" {
+		if exact, ok := idx.names[name]; ok {
+			f = exact
+		} else if _, rest, ok := strings.Cut(name, "."); ok {
+			if wildcard, ok := idx.names["*."+rest]; ok {
+				f = wildcard
+			}
+		}
+	}
+	if f == nil {
+		return nil
+	}
+	// Loaded on every call, so that renewed certificates and staples take effect.
+	return f.cert.Load()
+}
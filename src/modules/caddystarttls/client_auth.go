@@ -0,0 +1,128 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// clientCertChainKey is the connection variable holding the verified
+// certificate chain of an authenticated client, leaf first.
+const clientCertChainKey = "tls_client_cert_chain"
+
+// ClientAuth configures TLS client certificate authentication. The modes
+// and their defaults match Caddy's client_auth connection policy.
+type ClientAuth struct {
+	// How to authenticate clients: "request", "require", "verify_if_given"
+	// or "require_and_verify". Default: require_and_verify if a trust pool
+	// is configured, require otherwise.
+	Mode string `json:"mode,omitempty"`
+
+	// PEM files with the CA certificates that client certificates must chain to.
+	TrustPoolFiles []string `json:"trust_pool_files,omitempty"`
+
+	pool *x509.CertPool
+}
+
+// provision loads the trust pool and validates the mode.
+func (a *ClientAuth) provision() error {
+	switch a.Mode {
+	case "":
+		a.Mode = "require"
+		if len(a.TrustPoolFiles) > 0 {
+			a.Mode = "require_and_verify"
+		}
+	case "request", "require":
+	case "verify_if_given", "require_and_verify":
+		if len(a.TrustPoolFiles) == 0 {
+			return fmt.Errorf("client_auth: mode %s requires a trust_pool", a.Mode)
+		}
+	default:
+		return fmt.Errorf("client_auth: unsupported mode %q", a.Mode)
+	}
+
+	if len(a.TrustPoolFiles) == 0 {
+		return nil
+	}
+	a.pool = x509.NewCertPool()
+	for _, file := range a.TrustPoolFiles {
+		pemData, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("client_auth: reading trust pool: %v", err)
+		}
+		if !a.pool.AppendCertsFromPEM(pemData) {
+			return fmt.Errorf("client_auth: no certificates found in %s", file)
+		}
+	}
+	return nil
+}
+
+// configure sets up cfg to authenticate clients.
+func (a *ClientAuth) configure(cfg *tls.Config) {
+	switch a.Mode {
+	case "request":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "require":
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "verify_if_given":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	cfg.ClientCAs = a.pool
+}
+
+// unmarshalCaddyfile parses a client_auth block:
+//
+//	client_auth {
+//		mode [request|require|verify_if_given|require_and_verify]
+//		trust_pool file <pem_file>... {
+//			pem_file <pem_file>...
+//		}
+//	}
+func (a *ClientAuth) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Mode = d.Val()
+		case "trust_pool":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() != "file" {
+				return d.Errf("unsupported trust_pool source: %s", d.Val())
+			}
+			a.TrustPoolFiles = append(a.TrustPoolFiles, d.RemainingArgs()...)
+			for poolNesting := d.Nesting(); d.NextBlock(poolNesting); {
+				if d.Val() != "pem_file" {
+					return d.Errf("unrecognized trust_pool option: %s", d.Val())
+				}
+				files := d.RemainingArgs()
+				if len(files) == 0 {
+					return d.ArgErr()
+				}
+				a.TrustPoolFiles = append(a.TrustPoolFiles, files...)
+			}
+		default:
+			return d.Errf("unrecognized client_auth option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// storeClientCertChain records the verified client certificate chain on cx.
+func storeClientCertChain(cx *layer4.Connection, state *tls.ConnectionState) {
+	if len(state.VerifiedChains) > 0 {
+		cx.SetVar(clientCertChainKey, state.VerifiedChains[0])
+	}
+}
@@ -0,0 +1,161 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCustomTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "relay.example.com"))
+
+	ca, caKey := newTestCA(t, "Device CA", nil, nil)
+	poolPath := filepath.Join(dir, "devices.pem")
+	if err := os.WriteFile(poolPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	device := testCertOptions{names: []string{"plc-01"}, issuer: ca, issuerKey: caKey, client: true}.issue(t)
+	otherCA, otherKey := newTestCA(t, "Other CA", nil, nil)
+	stranger := testCertOptions{names: []string{"stranger"}, issuer: otherCA, issuerKey: otherKey, client: true}.issue(t)
+
+	tests := []struct {
+		name       string
+		mode       string
+		clientCert *tls.Certificate
+		wantErr    bool
+		wantChain  string
+	}{
+		{name: "verified device", mode: "require_and_verify", clientCert: &device, wantChain: "plc-01"},
+		{name: "default mode verifies", clientCert: &device, wantChain: "plc-01"},
+		{name: "missing certificate", mode: "require_and_verify", wantErr: true},
+		{name: "untrusted certificate", mode: "require_and_verify", clientCert: &stranger, wantErr: true},
+		{name: "verify if given without certificate", mode: "verify_if_given"},
+		{name: "verify if given with untrusted certificate", mode: "verify_if_given", clientCert: &stranger, wantErr: true},
+		{name: "require accepts any certificate", mode: "require", clientCert: &stranger},
+		{name: "request without certificate", mode: "request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientAuth := &ClientAuth{Mode: tt.mode}
+			if tt.mode != "require" && tt.mode != "request" {
+				clientAuth.TrustPoolFiles = []string{poolPath}
+			}
+			c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, ClientAuth: clientAuth}
+			provisionCustomTLS(t, c)
+
+			cfg := &tls.Config{InsecureSkipVerify: true}
+			if tt.clientCert != nil {
+				// Always present the certificate, even if the server's
+				// acceptable CAs do not include its issuer.
+				cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return tt.clientCert, nil
+				}
+			}
+			_, cx, err := handshakeCustomTLS(t, c, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Handle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			chain, _ := cx.GetVar(clientCertChainKey).([]*x509.Certificate)
+			if tt.wantChain == "" {
+				if chain != nil {
+					t.Errorf("client chain stored for unverified client: %v", chain[0].Subject)
+				}
+				return
+			}
+			if len(chain) != 2 || chain[0].Subject.CommonName != tt.wantChain || chain[1].Subject.CommonName != "Device CA" {
+				t.Errorf("stored client chain = %v, want %s issued by Device CA", chain, tt.wantChain)
+			}
+		})
+	}
+}
+
+func TestClientAuthProvision(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     ClientAuth
+		wantMode string
+		wantErr  bool
+	}{
+		{name: "default without trust pool", wantMode: "require"},
+		{name: "verify without trust pool", auth: ClientAuth{Mode: "require_and_verify"}, wantErr: true},
+		{name: "unknown mode", auth: ClientAuth{Mode: "optional"}, wantErr: true},
+		{name: "missing trust pool file", auth: ClientAuth{TrustPoolFiles: []string{"/nonexistent.pem"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.provision()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.auth.Mode != tt.wantMode {
+				t.Errorf("mode = %s, want %s", tt.auth.Mode, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestClientAuthUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    ClientAuth
+		wantErr bool
+	}{
+		{
+			name: "mode and trust pool files",
+			input: `client_auth {
+				mode verify_if_given
+				trust_pool file /certs/devices.pem /certs/legacy.pem
+			}`,
+			want: ClientAuth{Mode: "verify_if_given", TrustPoolFiles: []string{"/certs/devices.pem", "/certs/legacy.pem"}},
+		},
+		{
+			name: "trust pool block",
+			input: `client_auth {
+				trust_pool file {
+					pem_file /certs/devices.pem
+				}
+			}`,
+			want: ClientAuth{TrustPoolFiles: []string{"/certs/devices.pem"}},
+		},
+		{
+			name: "unsupported trust pool source",
+			input: `client_auth {
+				trust_pool pki_root
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown option",
+			input: `client_auth {
+				verifier leaf
+			}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			d.Next()
+			var a ClientAuth
+			err := a.unmarshalCaddyfile(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(a, tt.want) {
+				t.Errorf("unmarshalCaddyfile() = %+v, want %+v", a, tt.want)
+			}
+		})
+	}
+}
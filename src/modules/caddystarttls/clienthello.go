@@ -0,0 +1,355 @@
+package caddystarttls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	recordHeaderLen          = 5
+	// maxClientHelloLen bounds how much is buffered to fingerprint a
+	// ClientHello; real ones are a few kilobytes at most.
+	maxClientHelloLen = 64 << 10
+)
+
+// TLS extensions the fingerprints look at.
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+var (
+	errIncompleteClientHello = errors.New("incomplete ClientHello")
+	errNotClientHello        = errors.New("not a TLS ClientHello")
+)
+
+// clientHello holds the fields of a ClientHello that TLS fingerprints are
+// made of, in the order the client sent them.
+type clientHello struct {
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	serverName          string
+	curves              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpn                []string
+	supportedVersions   []uint16
+}
+
+// clientHelloMessage reassembles the ClientHello handshake message from the
+// TLS records at the start of data. It returns errIncompleteClientHello if
+// data ends before the message does.
+func clientHelloMessage(data []byte) ([]byte, error) {
+	var msg []byte
+	for {
+		if len(data) < recordHeaderLen {
+			return nil, errIncompleteClientHello
+		}
+		if data[0] != recordTypeHandshake {
+			return nil, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < recordHeaderLen+n {
+			return nil, errIncompleteClientHello
+		}
+		msg = append(msg, data[recordHeaderLen:recordHeaderLen+n]...)
+		data = data[recordHeaderLen+n:]
+
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return nil, errNotClientHello
+		}
+		msgLen := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if msgLen > maxClientHelloLen {
+			return nil, fmt.Errorf("ClientHello of %d bytes is too large", msgLen)
+		}
+		if len(msg) >= msgLen {
+			return msg[:msgLen], nil
+		}
+	}
+}
+
+// readClientHello reads TLS records from r until they hold a complete
+// ClientHello and returns the message.
+func readClientHello(r io.Reader) ([]byte, error) {
+	var data []byte
+	for len(data) <= maxClientHelloLen {
+		hdr := make([]byte, recordHeaderLen)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		if hdr[0] != recordTypeHandshake {
+			return nil, errNotClientHello
+		}
+		record := make([]byte, recordHeaderLen+int(binary.BigEndian.Uint16(hdr[3:5])))
+		copy(record, hdr)
+		if _, err := io.ReadFull(r, record[recordHeaderLen:]); err != nil {
+			return nil, err
+		}
+		data = append(data, record...)
+
+		msg, err := clientHelloMessage(data)
+		if err != errIncompleteClientHello {
+			return msg, err
+		}
+	}
+	return nil, fmt.Errorf("ClientHello exceeds %d bytes", maxClientHelloLen)
+}
+
+// parseClientHello parses a ClientHello handshake message.
+func parseClientHello(msg []byte) (*clientHello, error) {
+	if len(msg) < 4 || msg[0] != handshakeTypeClientHello {
+		return nil, errNotClientHello
+	}
+	s := cryptobyte.String(msg[4:])
+	h := new(clientHello)
+	var sessionID, cipherSuites, compression cryptobyte.String
+	if !s.ReadUint16(&h.version) || !s.Skip(32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, fmt.Errorf("malformed ClientHello")
+	}
+	for !cipherSuites.Empty() {
+		var suite uint16
+		if !cipherSuites.ReadUint16(&suite) {
+			return nil, fmt.Errorf("malformed ClientHello cipher suites")
+		}
+		h.cipherSuites = append(h.cipherSuites, suite)
+	}
+	if s.Empty() {
+		return h, nil
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, fmt.Errorf("malformed ClientHello extensions")
+	}
+	for !extensions.Empty() {
+		var ext uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ext) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, fmt.Errorf("malformed ClientHello extensions")
+		}
+		h.extensions = append(h.extensions, ext)
+		if err := h.parseExtension(ext, data); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// parseExtension records the contents of the extensions fingerprints use.
+func (h *clientHello) parseExtension(ext uint16, data cryptobyte.String) error {
+	ok := true
+	switch ext {
+	case extServerName:
+		var names cryptobyte.String
+		ok = data.ReadUint16LengthPrefixed(&names)
+		for ok && !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			ok = names.ReadUint8(&nameType) && names.ReadUint16LengthPrefixed(&name)
+			if ok && nameType == 0 {
+				h.serverName = string(name)
+			}
+		}
+	case extSupportedGroups:
+		h.curves, ok = readUint16List(&data)
+	case extECPointFormats:
+		var formats cryptobyte.String
+		ok = data.ReadUint8LengthPrefixed(&formats)
+		h.pointFormats = formats
+	case extSignatureAlgorithms:
+		h.signatureAlgorithms, ok = readUint16List(&data)
+	case extALPN:
+		var protos cryptobyte.String
+		ok = data.ReadUint16LengthPrefixed(&protos)
+		for ok && !protos.Empty() {
+			var proto cryptobyte.String
+			ok = protos.ReadUint8LengthPrefixed(&proto)
+			h.alpn = append(h.alpn, string(proto))
+		}
+	case extSupportedVersions:
+		var versions cryptobyte.String
+		ok = data.ReadUint8LengthPrefixed(&versions)
+		for ok && !versions.Empty() {
+			var v uint16
+			ok = versions.ReadUint16(&v)
+			h.supportedVersions = append(h.supportedVersions, v)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("malformed ClientHello extension %d", ext)
+	}
+	return nil
+}
+
+// readUint16List reads a list of uint16 values with a two-byte length prefix.
+func readUint16List(s *cryptobyte.String) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) {
+		return nil, false
+	}
+	var values []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// pick at random and fingerprints therefore ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns values without GREASE values.
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// ja3String returns the JA3 fingerprint before hashing:
+// version,ciphers,extensions,curves,point formats.
+func (h *clientHello) ja3String() string {
+	points := make([]uint16, len(h.pointFormats))
+	for i, p := range h.pointFormats {
+		points[i] = uint16(p)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGREASE(h.cipherSuites)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.curves)),
+		joinDecimal(points),
+	}, ",")
+}
+
+// ja3 returns the JA3 fingerprint, the MD5 of ja3String in hex.
+func (h *clientHello) ja3() string {
+	sum := md5.Sum([]byte(h.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint for TLS over TCP, e.g.
+// t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (h *clientHello) ja4() string {
+	ciphers := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	sni := "i"
+	if slices.Contains(extensions, extServerName) {
+		sni = "d"
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinHex(ciphers))
+
+	// The server name and ALPN are already part of a.
+	extensions = slices.DeleteFunc(extensions, func(ext uint16) bool {
+		return ext == extServerName || ext == extALPN
+	})
+	slices.Sort(extensions)
+	c := "000000000000"
+	if len(extensions) > 0 {
+		raw := joinHex(extensions)
+		if algs := withoutGREASE(h.signatureAlgorithms); len(algs) > 0 {
+			raw += "_" + joinHex(algs)
+		}
+		c = ja4Hash(raw)
+	}
+	return a + "_" + b + "_" + c
+}
+
+// ja4Version returns the highest TLS version the client offers, as JA4
+// writes it.
+func ja4Version(h *clientHello) string {
+	version := h.version
+	if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the first ALPN protocol,
+// or of its hex representation if they are not alphanumeric.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	proto := alpn[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlphanumeric(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of s, or
+// zeros for an empty list.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,112 @@
+package caddystarttls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+)
+
+// captureClientHello returns the ClientHello message a Go TLS client with
+// cfg sends.
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	clientEnd, serverEnd := net.Pipe()
+	defer serverEnd.Close()
+	go func() {
+		defer clientEnd.Close()
+		tls.Client(clientEnd, cfg).Handshake()
+	}()
+	msg, err := readClientHello(serverEnd)
+	if err != nil {
+		t.Fatalf("readClientHello: %v", err)
+	}
+	return msg
+}
+
+func TestParseClientHello(t *testing.T) {
+	msg := captureClientHello(t, &tls.Config{ServerName: "mail.example.com", NextProtos: []string{"smtp"}, MinVersion: tls.VersionTLS12})
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+	if hello.version != tls.VersionTLS12 {
+		t.Errorf("version = %#x, want TLS 1.2 for compatibility", hello.version)
+	}
+	if hello.serverName != "mail.example.com" {
+		t.Errorf("server name = %q", hello.serverName)
+	}
+	if !slices.Equal(hello.alpn, []string{"smtp"}) {
+		t.Errorf("alpn = %v", hello.alpn)
+	}
+	if !slices.Contains(hello.supportedVersions, tls.VersionTLS13) {
+		t.Errorf("supported versions = %v, want TLS 1.3", hello.supportedVersions)
+	}
+	if len(hello.cipherSuites) == 0 || len(hello.curves) == 0 || len(hello.signatureAlgorithms) == 0 {
+		t.Errorf("cipher suites, curves or signature algorithms missing: %+v", hello)
+	}
+
+	// A ClientHello split across two records is reassembled.
+	var split []byte
+	for _, fragment := range [][]byte{msg[:100], msg[100:]} {
+		split = append(split, recordTypeHandshake, 0x03, 0x01, byte(len(fragment)>>8), byte(len(fragment)))
+		split = append(split, fragment...)
+	}
+	reassembled, err := readClientHello(bytes.NewReader(split))
+	if err != nil || !bytes.Equal(reassembled, msg) {
+		t.Errorf("reassembled ClientHello differs, err = %v", err)
+	}
+	if _, err := clientHelloMessage(split[:len(split)-1]); err != errIncompleteClientHello {
+		t.Errorf("truncated ClientHello: err = %v", err)
+	}
+	if _, err := readClientHello(bytes.NewReader([]byte("EHLO mail.example.com\r\n"))); err != errNotClientHello {
+		t.Errorf("plain text: err = %v", err)
+	}
+}
+
+func TestJA3(t *testing.T) {
+	// The example from the JA3 documentation, plus GREASE values.
+	hello := &clientHello{
+		version:      769,
+		cipherSuites: []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		extensions:   []uint16{0, 10, 0x1a1a, 11},
+		curves:       []uint16{23, 24, 25},
+		pointFormats: []uint8{0},
+	}
+	if got, want := hello.ja3String(), "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"; got != want {
+		t.Errorf("ja3String() = %s, want %s", got, want)
+	}
+	if got, want := hello.ja3(), "ada70206e40642a3e4461f35503241d5"; got != want {
+		t.Errorf("ja3() = %s, want %s", got, want)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// The Chrome example from the JA4 documentation, plus GREASE values.
+	chrome := &clientHello{
+		version: tls.VersionTLS12,
+		cipherSuites: []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+			0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		extensions: []uint16{0x3a3a, 0x0012, 0x000b, 0x4469, 0x0010, 0x0005, 0x002b, 0xff01, 0x0033,
+			0x0017, 0x000d, 0x0023, 0x000a, 0x001b, 0x0000, 0x002d, 0x0015},
+		signatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		alpn:                []string{"h2", "http/1.1"},
+		supportedVersions:   []uint16{0x5a5a, 0x0304, 0x0303},
+	}
+
+	tests := []struct {
+		name  string
+		hello *clientHello
+		want  string
+	}{
+		{"chrome", chrome, "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"no extensions", &clientHello{version: tls.VersionTLS12, cipherSuites: []uint16{0x002f}}, "t12i010000_" + ja4Hash("002f") + "_000000000000"},
+		{"non-alphanumeric alpn", &clientHello{version: tls.VersionTLS10, alpn: []string{"\xabx\xcd"}}, "t10i0000ad_000000000000_000000000000"},
+	}
+	for _, tt := range tests {
+		if got := tt.hello.ja4(); got != tt.want {
+			t.Errorf("%s: ja4() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
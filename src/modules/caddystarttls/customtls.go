@@ -1,8 +1,12 @@
 package caddystarttls
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -14,19 +18,117 @@ func init() {
 	caddy.RegisterModule(&CustomTLS{})
 }
 
-// CustomTLS is a layer4 handler that terminates TLS using a specific
-// certificate and key file.
+// CustomTLS is a layer4 handler that terminates TLS using certificate and
+// key files, or certificates managed by Caddy's tls app. With several
+// certificates, the one to serve is selected by SNI.
 type CustomTLS struct {
 	// Path to the certificate file
 	CertPath string `json:"cert_path,omitempty"`
 	// Path to the key file
 	KeyPath string `json:"key_path,omitempty"`
 
-	// Optional default SNI if needed
+	// Password of encrypted (PKCS#8) private keys. Applies to key_path,
+	// cert_dir and certificates without a password of their own.
+	// Supports placeholders, e.g. {env.TLS_KEY_PASSWORD}.
+	KeyPassword string `json:"key_password,omitempty"`
+
+	// PKCS#12 (.pfx/.p12) bundle with the certificate, its key and
+	// intermediates, as an alternative to cert_path and key_path.
+	PKCS12File string `json:"pkcs12_file,omitempty"`
+	// Password of the PKCS#12 bundle. Supports placeholders.
+	PKCS12Password string `json:"pkcs12_password,omitempty"`
+
+	// Additional certificate and key pairs to select from by SNI.
+	Certificates []CertKeyPair `json:"certificates,omitempty"`
+
+	// Directory with <name>.pem certificates and matching <name>.key
+	// files to select from by SNI. Files are picked up as they are added.
+	// Pairs that fail to load or have expired are logged and skipped.
+	CertDir string `json:"cert_dir,omitempty"`
+
+	// Certificates from Caddy's tls app to serve instead of the files
+	// above, which remain the fallback for names it has none for.
+	Managed *ManagedCertificates `json:"managed,omitempty"`
+
+	// Server name to select the certificate by when the ClientHello carries
+	// no SNI, as is usual for SMTP clients connecting by IP. It is also
+	// recorded as the connection's server name for later handlers.
 	DefaultSNI string `json:"default_sni,omitempty"`
 
+	// Named TLS profile: "modern" (TLS 1.3 only), "intermediate" (TLS 1.2+
+	// with AEAD ciphers) or "legacy_smtp" (TLS 1.2+ including CBC ciphers for
+	// older SMTP clients like checktls.com). Default: legacy_smtp.
+	// The options below override the corresponding profile settings.
+	Profile string `json:"profile,omitempty"`
+
+	// Minimum and maximum TLS protocol versions, e.g. "tls1.2" or "tls1.3".
+	ProtocolMin string `json:"protocol_min,omitempty"`
+	ProtocolMax string `json:"protocol_max,omitempty"`
+
+	// Cipher suites for TLS 1.2, by their standard names.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+
+	// Key exchange curves in order of preference, e.g. x25519mlkem768.
+	Curves []string `json:"curves,omitempty"`
+
+	// ALPN protocols to negotiate, in order of preference. The negotiated
+	// protocol is available as {l4.tls.proto}.
+	ALPN []string `json:"alpn,omitempty"`
+
+	// Optional TLS client certificate authentication.
+	ClientAuth *ClientAuth `json:"client_auth,omitempty"`
+
+	// OCSP stapling settings. Stapling is on by default.
+	OCSP *OCSPStapling `json:"ocsp,omitempty"`
+
+	// Session ticket keys, e.g. shared between nodes through Caddy's
+	// storage. By default, each process uses its own keys.
+	SessionTickets *SessionTickets `json:"session_tickets,omitempty"`
+
+	// Encrypted Client Hello, to keep the server names of connections off
+	// the wire. Connections are handled with the encrypted server name.
+	ECH *ECH `json:"ech,omitempty"`
+
+	// Remaining lifetimes at which a warning is logged for a file
+	// certificate about to expire. Default: 30d, 14d and 3d.
+	ExpiryWarnings []caddy.Duration `json:"expiry_warnings,omitempty"`
+
+	// Serve file certificates that have already expired instead of failing
+	// to provision, or skipping them if they were found in cert_dir.
+	AllowExpired bool `json:"allow_expired,omitempty"`
+
+	// Maximum number of handshakes in progress at once. Further connections
+	// wait for a free slot, so that a connection flood cannot take every
+	// core for handshakes. A connection only takes a slot once its
+	// ClientHello has arrived. 0 means no limit.
+	MaxConcurrentHandshakes int `json:"max_concurrent_handshakes,omitempty"`
+
+	// How long a connection waits for a handshake slot before it is
+	// closed. Default: 5s.
+	HandshakeQueueTimeout caddy.Duration `json:"handshake_queue_timeout,omitempty"`
+
+	// Maximum duration of a handshake, including the wait for the client's
+	// ClientHello. 0 (the default) or a negative value means no limit.
+	HandshakeTimeout caddy.Duration `json:"handshake_timeout,omitempty"`
+
+	// How long a client may take to send its ClientHello after
+	// connecting. 0 (the default) or a negative value means no limit.
+	ClientHelloTimeout caddy.Duration `json:"client_hello_timeout,omitempty"`
+
+	// How often the certificate and key files are checked for changes.
+	// A renewed pair is picked up without reloading Caddy. Default: 1m.
+	// Set to a negative value to disable.
+	ReloadInterval caddy.Duration `json:"reload_interval,omitempty"`
+
 	logger    *zap.Logger
 	tlsConfig *tls.Config
+	certs     *certSet
+	stapler   *ocspStapler
+
+	handshakeSlots chan struct{}
+
+	// Only touched by Provision and the maintenance goroutine.
+	expiryReported map[string]struct{}
 
 	Next layer4.Handler `json:"-"`
 }
@@ -41,36 +143,253 @@ func (*CustomTLS) CaddyModule() caddy.ModuleInfo {
 func (c *CustomTLS) Provision(ctx caddy.Context) error {
 	c.logger = ctx.Logger()
 
-	if c.CertPath == "" || c.KeyPath == "" {
-		return fmt.Errorf("cert_path and key_path are required")
+	if (c.CertPath == "") != (c.KeyPath == "") {
+		return fmt.Errorf("cert_path and key_path must be set together")
+	}
+	if c.MaxConcurrentHandshakes < 0 {
+		return fmt.Errorf("max_concurrent_handshakes must not be negative")
+	}
+	if c.MaxConcurrentHandshakes > 0 {
+		c.handshakeSlots = make(chan struct{}, c.MaxConcurrentHandshakes)
+	}
+	if c.HandshakeQueueTimeout <= 0 {
+		c.HandshakeQueueTimeout = caddy.Duration(defaultHandshakeQueueTimeout)
+	}
+
+	repl := caddy.NewReplacer()
+	keyPassword := repl.ReplaceKnown(c.KeyPassword, "")
+	var pairs []*certFile
+	if c.CertPath != "" {
+		pairs = append(pairs, &certFile{certPath: c.CertPath, keyPath: c.KeyPath, password: keyPassword})
+	}
+	if c.PKCS12File != "" {
+		pairs = append(pairs, &certFile{certPath: c.PKCS12File, password: repl.ReplaceKnown(c.PKCS12Password, ""), pkcs12: true})
+	}
+	for _, p := range c.Certificates {
+		if p.CertPath == "" || p.KeyPath == "" {
+			return fmt.Errorf("certificates: cert_path and key_path are required")
+		}
+		password := keyPassword
+		if p.KeyPassword != "" {
+			password = repl.ReplaceKnown(p.KeyPassword, "")
+		}
+		pairs = append(pairs, &certFile{certPath: p.CertPath, keyPath: p.KeyPath, password: password})
+	}
+	if len(pairs) == 0 && c.CertDir == "" && c.Managed == nil {
+		return fmt.Errorf("cert_path and key_path, pkcs12_file, certificates, cert_dir or managed is required")
+	}
+	if c.Managed != nil {
+		if err := c.Managed.provision(ctx); err != nil {
+			return err
+		}
 	}
 
-	cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
-	if err != nil {
-		return fmt.Errorf("loading key pair: %v", err)
+	// The first certificate loaded is served to clients whose SNI matches none.
+	c.certs = newCertSet(pairs, c.CertDir, keyPassword)
+	_, errs := c.certs.reload()
+	var fatal []error
+	for _, err := range errs {
+		if errors.As(err, new(dirPairError)) {
+			c.logger.Warn("skipping certificate in cert_dir", zap.Error(err))
+			continue
+		}
+		fatal = append(fatal, err)
+	}
+	if len(fatal) > 0 {
+		return fmt.Errorf("loading key pair: %v", errors.Join(fatal...))
+	}
+	if c.excludeExpiredDirPairs(time.Now()) {
+		c.certs.rebuild()
+	}
+	if c.certs.certificate("") == nil && c.Managed == nil {
+		return fmt.Errorf("no certificates found in %s", c.CertDir)
+	}
+	if err := c.checkExpired(c.certs.pairs, time.Now()); err != nil {
+		return err
 	}
 
 	c.tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		// Explicitly allow TLS 1.2 and CBC ciphers to support older SMTP clients like checktls.com
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName := c.serverName(hello.ServerName)
+			if c.Managed != nil {
+				if cert := c.Managed.certificate(serverName); cert != nil {
+					return cert, nil
+				}
+			}
+			if cert := c.certs.certificate(serverName); cert != nil {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("no certificate available for %q", serverName)
+		},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if r, ok := hello.Conn.(*clientHelloRecorder); ok {
+				r.fingerprint()
+				if err := c.clientHelloReceived(hello.Context(), r); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
 		},
-		MinVersion: tls.VersionTLS12,
+		NextProtos: c.ALPN,
+	}
+	if err := c.applyTLSProfile(c.tlsConfig); err != nil {
+		return err
+	}
+	if c.ClientAuth != nil {
+		if err := c.ClientAuth.provision(); err != nil {
+			return err
+		}
+		c.ClientAuth.configure(c.tlsConfig)
+	}
+	if c.SessionTickets != nil {
+		if err := c.SessionTickets.provision(ctx); err != nil {
+			return err
+		}
+		if err := c.SessionTickets.configure(ctx, c.tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.ECH != nil {
+		if c.tlsConfig.MaxVersion != 0 && c.tlsConfig.MaxVersion < tls.VersionTLS13 {
+			return fmt.Errorf("ech requires TLS 1.3, but the maximum protocol is %s",
+				tls.VersionName(c.tlsConfig.MaxVersion))
+		}
+		if err := c.ECH.provision(ctx, c.logger); err != nil {
+			return err
+		}
+		if err := c.ECH.configure(ctx, c.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.OCSP == nil || !c.OCSP.Disabled {
+		c.stapler = newOCSPStapler(c.OCSP, c.logger)
+		// Only the cache is read here; responders are asked in the
+		// background, so an unreachable one cannot stall config loads.
+		c.updateStaples(ctx, c.certs.files(), false)
+	}
+
+	if c.ExpiryWarnings == nil {
+		c.ExpiryWarnings = defaultExpiryWarnings
+	}
+	registerMetrics(ctx, certificateExpiry, tlsHandshakeFailures, tlsHandshakesQueued, tlsHandshakesRejected)
+	c.checkExpiry(c.certs.files(), time.Now())
+
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultReloadInterval
 	}
+	go c.maintainCertificates(ctx, c.certs.files())
 
 	return nil
 }
 
+// serverName returns the effective server name for a client's SNI.
+func (c *CustomTLS) serverName(sni string) string {
+	if sni == "" {
+		return c.DefaultSNI
+	}
+	return sni
+}
+
+// maintainCertificates reloads certificates whenever their files change,
+// keeps their OCSP staples current and watches their expiry, and rotates
+// session ticket and ECH keys, until the config that provisioned the
+// handler is unloaded. It starts by fetching the OCSP staples of files, the
+// certificates Provision loaded.
+func (c *CustomTLS) maintainCertificates(ctx context.Context, files []*certFile) {
+	expiry := time.NewTicker(expiryCheckInterval)
+	defer expiry.Stop()
+	var reload, staple, tickets, ech <-chan time.Time
+	if c.ReloadInterval > 0 {
+		ticker := time.NewTicker(time.Duration(c.ReloadInterval))
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+	if c.stapler != nil {
+		ticker := time.NewTicker(ocspCheckInterval)
+		defer ticker.Stop()
+		staple = ticker.C
+	}
+	if c.SessionTickets != nil && !c.SessionTickets.Disabled {
+		ticker := time.NewTicker(ticketKeyCheckInterval)
+		defer ticker.Stop()
+		tickets = ticker.C
+	}
+	if c.ECH != nil {
+		ticker := time.NewTicker(echKeyCheckInterval)
+		defer ticker.Stop()
+		ech = ticker.C
+	}
+	if c.stapler != nil {
+		c.updateStaples(ctx, files, true)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			reloaded := c.reloadCertificates()
+			if len(reloaded) == 0 {
+				continue
+			}
+			if c.excludeExpiredDirPairs(time.Now()) {
+				c.certs.rebuild()
+			}
+			if c.stapler != nil {
+				c.updateStaples(ctx, reloaded, true)
+			}
+			c.checkExpiry(c.certs.files(), time.Now())
+		case <-staple:
+			c.updateStaples(ctx, c.certs.files(), true)
+		case now := <-expiry.C:
+			c.checkExpiry(c.certs.files(), now)
+		case <-tickets:
+			if err := c.SessionTickets.update(ctx, c.tlsConfig); err != nil {
+				c.logger.Warn("updating session ticket keys failed", zap.Error(err))
+			}
+		case <-ech:
+			if err := c.ECH.update(ctx); err != nil {
+				c.logger.Warn("updating ECH keys failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// updateStaples refreshes the OCSP staples of files as needed, asking the
+// responders only if fetch is set. Errors are logged; a certificate keeps
+// its staple until the staple expires.
+func (c *CustomTLS) updateStaples(ctx context.Context, files []*certFile, fetch bool) {
+	rebuild := false
+	for _, f := range files {
+		changed, err := c.stapler.staple(ctx, f, fetch)
+		if err != nil {
+			c.logger.Warn("OCSP stapling failed", zap.Error(err))
+		}
+		rebuild = rebuild || changed
+	}
+	if rebuild {
+		c.certs.rebuild()
+	}
+}
+
+// reloadCertificates checks the certificate files once and returns the pairs
+// that changed. A pair that fails to load is logged and its previous
+// certificate keeps being served.
+func (c *CustomTLS) reloadCertificates() []*certFile {
+	reloaded, errs := c.certs.reload()
+	for _, err := range errs {
+		c.logger.Error("reloading certificate failed, keeping previous certificate", zap.Error(err))
+	}
+	for _, f := range reloaded {
+		fields := []zap.Field{zap.String("cert_path", f.certPath)}
+		if leaf := f.cert.Load().Leaf; leaf != nil {
+			fields = append(fields, zap.Strings("names", leaf.DNSNames), zap.Time("not_after", leaf.NotAfter))
+		}
+		c.logger.Info("reloaded certificate", fields...)
+	}
+	return reloaded
+}
+
 func (c *CustomTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		args := d.RemainingArgs()
@@ -93,11 +412,170 @@ func (c *CustomTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				c.KeyPath = d.Val()
+			case "key_password":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.KeyPassword = d.Val()
+			case "pkcs12_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.PKCS12File = d.Val()
+			case "pkcs12_password":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.PKCS12Password = d.Val()
+			case "certificate":
+				args := d.RemainingArgs()
+				if len(args) != 2 && len(args) != 3 {
+					return d.ArgErr()
+				}
+				pair := CertKeyPair{CertPath: args[0], KeyPath: args[1]}
+				if len(args) == 3 {
+					pair.KeyPassword = args[2]
+				}
+				c.Certificates = append(c.Certificates, pair)
+			case "cert_dir":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.CertDir = d.Val()
+			case "managed":
+				c.Managed = new(ManagedCertificates)
+				if err := c.Managed.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
 			case "default_sni":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
 				c.DefaultSNI = d.Val()
+			case "profile":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Profile = d.Val()
+			case "protocols":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				c.ProtocolMin = args[0]
+				if len(args) == 2 {
+					c.ProtocolMax = args[1]
+				}
+			case "ciphers":
+				c.CipherSuites = d.RemainingArgs()
+				if len(c.CipherSuites) == 0 {
+					return d.ArgErr()
+				}
+			case "curves":
+				c.Curves = d.RemainingArgs()
+				if len(c.Curves) == 0 {
+					return d.ArgErr()
+				}
+			case "alpn":
+				c.ALPN = d.RemainingArgs()
+				if len(c.ALPN) == 0 {
+					return d.ArgErr()
+				}
+			case "ocsp":
+				c.OCSP = new(OCSPStapling)
+				if err := c.OCSP.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "session_tickets":
+				c.SessionTickets = new(SessionTickets)
+				if err := c.SessionTickets.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "ech":
+				c.ECH = new(ECH)
+				if err := c.ECH.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "client_auth":
+				c.ClientAuth = new(ClientAuth)
+				if err := c.ClientAuth.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "expiry_warnings":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				c.ExpiryWarnings = nil
+				for _, arg := range args {
+					dur, err := caddy.ParseDuration(arg)
+					if err != nil {
+						return d.Errf("invalid expiry_warnings: %v", err)
+					}
+					c.ExpiryWarnings = append(c.ExpiryWarnings, caddy.Duration(dur))
+				}
+			case "allow_expired":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.AllowExpired = true
+			case "max_concurrent_handshakes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxHandshakes, err := strconv.Atoi(d.Val())
+				if err != nil || maxHandshakes < 0 {
+					return d.Errf("invalid max_concurrent_handshakes: %s", d.Val())
+				}
+				c.MaxConcurrentHandshakes = maxHandshakes
+			case "handshake_queue_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid handshake_queue_timeout: %v", err)
+				}
+				c.HandshakeQueueTimeout = caddy.Duration(dur)
+			case "handshake_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "off" {
+					c.HandshakeTimeout = -1
+					continue
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid handshake_timeout: %v", err)
+				}
+				c.HandshakeTimeout = caddy.Duration(dur)
+			case "client_hello_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "off" {
+					c.ClientHelloTimeout = -1
+					continue
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid client_hello_timeout: %v", err)
+				}
+				c.ClientHelloTimeout = caddy.Duration(dur)
+			case "reload_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "off" {
+					c.ReloadInterval = -1
+					continue
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid reload_interval: %v", err)
+				}
+				c.ReloadInterval = caddy.Duration(dur)
 			default:
 				return d.Errf("unrecognized subdirective: %s", d.Val())
 			}
@@ -107,16 +585,53 @@ func (c *CustomTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 }
 
 func (c *CustomTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
-	tlsConn := tls.Server(cx, c.tlsConfig)
+	recorder := newClientHelloRecorder(cx)
+	tlsConn := tls.Server(recorder, c.tlsConfig)
 
 	// Perform handshake explicitly to catch errors early,
 	// otherwise it happens lazily on first read/write.
-	if err := tlsConn.HandshakeContext(cx.Context); err != nil {
-		c.logger.Error("TLS handshake failed", zap.Error(err), zap.String("remote", cx.Conn.RemoteAddr().String()))
+	if err := c.handshake(cx.Context, recorder, tlsConn); err != nil {
+		if errors.Is(err, errTooManyHandshakes) {
+			c.logger.Warn("TLS handshake rejected", zap.Error(err), zap.String("remote", cx.Conn.RemoteAddr().String()))
+			return err
+		}
+		// Fingerprint what was received if the handshake failed before the
+		// ClientHello was processed, e.g. because it was malformed.
+		recorder.fingerprint()
+		reason := classifyHandshakeError(err)
+		tlsHandshakeFailures.WithLabelValues(reason).Inc()
+		fields := []zap.Field{
+			zap.Error(err),
+			zap.String("reason", reason),
+			zap.String("remote", cx.Conn.RemoteAddr().String()),
+			zap.String("ja3", recorder.ja3),
+			zap.String("ja4", recorder.ja4),
+		}
+		if recorder.hello != nil {
+			fields = append(fields, recorder.hello.logFields()...)
+		}
+		c.logger.Error("TLS handshake failed", fields...)
 		return err
 	}
 
-	c.logger.Debug("TLS handshake successful", zap.String("remote", cx.Conn.RemoteAddr().String()))
+	state := tlsConn.ConnectionState()
+	state.ServerName = c.serverName(state.ServerName)
+	appendConnectionState(cx, &state)
+	storeClientCertChain(cx, &state)
+	setTLSPlaceholders(cx, &state)
+
+	fields := []zap.Field{
+		zap.String("remote", cx.Conn.RemoteAddr().String()),
+		zap.String("ja3", recorder.ja3),
+		zap.String("ja4", recorder.ja4),
+	}
+	if state.ECHAccepted {
+		fields = append(fields, zap.String("server_name", state.ServerName))
+	}
+	if len(state.PeerCertificates) > 0 {
+		fields = append(fields, zap.String("client_subject", state.PeerCertificates[0].Subject.String()))
+	}
+	c.logger.Debug("TLS handshake successful", fields...)
 
 	// Preserve any Layer4 context while replacing the transport with TLS.
 	newCx := cx.Wrap(tlsConn)
@@ -124,6 +639,17 @@ func (c *CustomTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	return next.Handle(newCx)
 }
 
+// tlsConnectionStatesKey is the connection variable caddy-l4's tls handler
+// keeps handshake states in, so its matchers and placeholders also work for
+// connections terminated by custom_tls.
+const tlsConnectionStatesKey = "tls_connection_states"
+
+// appendConnectionState records the state of a completed handshake on cx.
+func appendConnectionState(cx *layer4.Connection, state *tls.ConnectionState) {
+	states, _ := cx.GetVar(tlsConnectionStatesKey).([]*tls.ConnectionState)
+	cx.SetVar(tlsConnectionStatesKey, append(states, state))
+}
+
 // Interface guards
 var (
 	_ layer4.NextHandler    = (*CustomTLS)(nil)
@@ -0,0 +1,559 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// writeTestKeyPair writes cert and its chain as PEM files named <name>.pem and
+// <name>.key into dir, the layout LocalCaddyHub uses for its certs directory.
+func writeTestKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+".key")
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// provisionCustomTLS provisions c with a context that is canceled when the test ends.
+func provisionCustomTLS(t *testing.T, c *CustomTLS) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := c.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+}
+
+// servedCertificate returns the certificate c presents for the given SNI.
+func servedCertificate(t *testing.T, c *CustomTLS, serverName string) *tls.Certificate {
+	t.Helper()
+	cert, err := c.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q): %v", serverName, err)
+	}
+	return cert
+}
+
+// handshakeCustomTLS runs c.Handle on one end of a pipe and a TLS client
+// with cfg on the other. It returns the client's connection state, the
+// connection the next handler was called with (nil if it was not reached)
+// and the error returned by Handle.
+func handshakeCustomTLS(t *testing.T, c *CustomTLS, cfg *tls.Config) (tls.ConnectionState, *layer4.Connection, error) {
+	t.Helper()
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	var nextCx *layer4.Connection
+	errc := make(chan error, 1)
+	go func() {
+		defer serverEnd.Close()
+		next := layer4.HandlerFunc(func(cx *layer4.Connection) error {
+			nextCx = cx
+			return nil
+		})
+		errc <- c.Handle(layer4.WrapConnection(serverEnd, nil, nil), next)
+	}()
+
+	client := tls.Client(clientEnd, cfg)
+	if err := client.Handshake(); err == nil {
+		// Wait for the server to finish or reject the handshake; with
+		// TLS 1.3 a rejected client certificate only shows up here.
+		client.Read(make([]byte, 1))
+	}
+	state := client.ConnectionState()
+	client.Close()
+	return state, nextCx, <-errc
+}
+
+func TestCustomTLSReloadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "old.example.com"))
+
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+	if got := servedCertificate(t, c, "").Leaf.DNSNames[0]; got != "old.example.com" {
+		t.Fatalf("initial certificate = %s", got)
+	}
+
+	// Unchanged files are not reloaded.
+	if changed, err := c.certs.pairs[0].load(); changed || err != nil {
+		t.Fatalf("load() on unchanged files = %v, %v", changed, err)
+	}
+
+	writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "new.example.com"))
+	c.reloadCertificates()
+	if got := servedCertificate(t, c, "").Leaf.DNSNames[0]; got != "new.example.com" {
+		t.Fatalf("certificate after renewal = %s", got)
+	}
+
+	// A mismatched pair must not replace the served certificate.
+	if err := os.WriteFile(certPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := c.certs.pairs[0].load(); changed || err == nil {
+		t.Fatalf("load() of invalid pair = %v, %v; want error", changed, err)
+	}
+	if got := servedCertificate(t, c, "").Leaf.DNSNames[0]; got != "new.example.com" {
+		t.Fatalf("certificate after bad renewal = %s", got)
+	}
+	// The same bad content is only reported once.
+	if err := os.Chtimes(certPath, time.Now(), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.certs.pairs[0].load(); err != nil {
+		t.Fatalf("load() of unchanged invalid pair reported again: %v", err)
+	}
+}
+
+func TestCustomTLSWatchCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "old.example.com"))
+
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: caddy.Duration(10 * time.Millisecond)}
+	provisionCustomTLS(t, c)
+
+	writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "new.example.com"))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCertificate(t, c, "").Leaf.DNSNames[0] != "new.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCustomTLSSelectCertificate(t *testing.T) {
+	dir := t.TempDir()
+	mailPath, mailKey := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	wildPath, wildKey := writeTestKeyPair(t, dir, "wildcard", newTestCertificate(t, "*.example.org", "example.org"))
+
+	c := &CustomTLS{
+		CertPath:       mailPath,
+		KeyPath:        mailKey,
+		Certificates:   []CertKeyPair{{CertPath: wildPath, KeyPath: wildKey}},
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, c)
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"mail.example.com", "mail.example.com"},
+		{"MAIL.example.com.", "mail.example.com"},
+		{"smtp.example.org", "*.example.org"},
+		{"example.org", "*.example.org"},
+		{"a.b.example.org", "mail.example.com"},
+		{"unknown.example.net", "mail.example.com"},
+		{"", "mail.example.com"},
+	}
+	for _, tt := range tests {
+		if got := servedCertificate(t, c, tt.serverName).Leaf.DNSNames[0]; got != tt.want {
+			t.Errorf("certificate for %q = %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestCustomTLSDefaultSNI(t *testing.T) {
+	dir := t.TempDir()
+	mailPath, mailKey := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	mxPath, mxKey := writeTestKeyPair(t, dir, "mx", newTestCertificate(t, "mx.example.net"))
+
+	c := &CustomTLS{
+		CertPath:       mailPath,
+		KeyPath:        mailKey,
+		Certificates:   []CertKeyPair{{CertPath: mxPath, KeyPath: mxKey}},
+		DefaultSNI:     "mx.example.net",
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, c)
+
+	tests := []struct {
+		name           string
+		serverName     string
+		wantCert       string
+		wantServerName string
+	}{
+		{"no SNI", "", "mx.example.net", "mx.example.net"},
+		{"client SNI wins", "mail.example.com", "mail.example.com", "mail.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cx, err := handshakeCustomTLS(t, c, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			if got := state.PeerCertificates[0].DNSNames[0]; got != tt.wantCert {
+				t.Errorf("served certificate = %s, want %s", got, tt.wantCert)
+			}
+			states, _ := cx.GetVar(tlsConnectionStatesKey).([]*tls.ConnectionState)
+			if len(states) != 1 || states[0].ServerName != tt.wantServerName {
+				t.Fatalf("connection states = %+v, want server name %s", states, tt.wantServerName)
+			}
+		})
+	}
+}
+
+func TestCustomTLSCertDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "a-mail", newTestCertificate(t, "mail.example.com"))
+	// A certificate without a key, such as a CA bundle, is ignored.
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("not a key pair"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A pair that does not load, such as a broken upload, is skipped.
+	writeBrokenKeyPair(t, dir, "broken")
+
+	c := &CustomTLS{CertDir: dir, ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+	if got := servedCertificate(t, c, "mx.example.net").Leaf.DNSNames[0]; got != "mail.example.com" {
+		t.Fatalf("fallback certificate = %s", got)
+	}
+
+	writeTestKeyPair(t, dir, "b-mx", newTestCertificate(t, "mx.example.net"))
+	c.reloadCertificates()
+	if got := servedCertificate(t, c, "mx.example.net").Leaf.DNSNames[0]; got != "mx.example.net" {
+		t.Fatalf("certificate added to cert_dir not served, got %s", got)
+	}
+
+	for _, name := range []string{"b-mx.pem", "b-mx.key"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.reloadCertificates()
+	if got := servedCertificate(t, c, "mx.example.net").Leaf.DNSNames[0]; got != "mail.example.com" {
+		t.Fatalf("certificate removed from cert_dir still served")
+	}
+}
+
+// writeBrokenKeyPair writes <name>.pem and <name>.key files that do not
+// form a valid pair.
+func writeBrokenKeyPair(t *testing.T, dir, name string) {
+	t.Helper()
+	for _, ext := range []string{".pem", ".key"} {
+		if err := os.WriteFile(filepath.Join(dir, name+ext), []byte("not PEM"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCustomTLSProvisionErrors(t *testing.T) {
+	brokenDir := t.TempDir()
+	writeBrokenKeyPair(t, brokenDir, "broken")
+	tests := []struct {
+		name string
+		c    CustomTLS
+	}{
+		{"nothing configured", CustomTLS{}},
+		{"cert without key", CustomTLS{CertPath: "/certs/mail.pem"}},
+		{"empty cert_dir", CustomTLS{CertDir: t.TempDir()}},
+		{"only broken pairs in cert_dir", CustomTLS{CertDir: brokenDir}},
+		{"missing files", CustomTLS{CertPath: "/nonexistent.pem", KeyPath: "/nonexistent.key"}},
+		{"managed without subjects or tags", CustomTLS{Managed: &ManagedCertificates{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := tt.c.Provision(ctx); err == nil {
+				t.Error("Provision() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestCustomTLSProfile(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+
+	tests := []struct {
+		name       string
+		c          CustomTLS
+		wantMin    uint16
+		wantMax    uint16
+		wantCBC    bool
+		wantCurves []tls.CurveID
+		wantErr    bool
+	}{
+		{name: "default is legacy_smtp", wantMin: tls.VersionTLS12, wantCBC: true},
+		{name: "intermediate", c: CustomTLS{Profile: "intermediate"}, wantMin: tls.VersionTLS12},
+		{
+			name:       "modern",
+			c:          CustomTLS{Profile: "modern"},
+			wantMin:    tls.VersionTLS13,
+			wantCurves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+		},
+		{
+			name:       "protocols override profile",
+			c:          CustomTLS{Profile: "modern", ProtocolMin: "tls1.2", ProtocolMax: "tls1.2"},
+			wantMin:    tls.VersionTLS12,
+			wantMax:    tls.VersionTLS12,
+			wantCurves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+		},
+		{
+			name:       "curves",
+			c:          CustomTLS{Curves: []string{"X25519MLKEM768", "x25519"}},
+			wantMin:    tls.VersionTLS12,
+			wantCBC:    true,
+			wantCurves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519},
+		},
+		{
+			name:    "ciphers",
+			c:       CustomTLS{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}},
+			wantMin: tls.VersionTLS12,
+			wantCBC: true,
+		},
+		{name: "unknown profile", c: CustomTLS{Profile: "paranoid"}, wantErr: true},
+		{name: "unsupported protocol", c: CustomTLS{ProtocolMin: "tls1.0"}, wantErr: true},
+		{name: "min above max", c: CustomTLS{ProtocolMin: "tls1.3", ProtocolMax: "tls1.2"}, wantErr: true},
+		{name: "unknown cipher", c: CustomTLS{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, wantErr: true},
+		{name: "unknown curve", c: CustomTLS{Curves: []string{"secp224r1"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.c
+			c.CertPath, c.KeyPath, c.ReloadInterval = certPath, keyPath, -1
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := c.Provision(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			cfg := c.tlsConfig
+			if cfg.MinVersion != tt.wantMin || cfg.MaxVersion != tt.wantMax {
+				t.Errorf("versions = %x-%x, want %x-%x", cfg.MinVersion, cfg.MaxVersion, tt.wantMin, tt.wantMax)
+			}
+			if got := slices.Contains(cfg.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA); got != tt.wantCBC {
+				t.Errorf("CBC cipher suites allowed = %v, want %v", got, tt.wantCBC)
+			}
+			if !slices.Equal(cfg.CurvePreferences, tt.wantCurves) {
+				t.Errorf("curves = %v, want %v", cfg.CurvePreferences, tt.wantCurves)
+			}
+		})
+	}
+}
+
+func TestCustomTLSUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    CustomTLS
+		wantErr bool
+	}{
+		{
+			name:  "paths as arguments",
+			input: `custom_tls /certs/mail.pem /certs/mail.key`,
+			want:  CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key"},
+		},
+		{
+			name: "reload interval",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				reload_interval 30s
+			}`,
+			want: CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key", ReloadInterval: caddy.Duration(30 * time.Second)},
+		},
+		{
+			name: "reload off",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				reload_interval off
+			}`,
+			want: CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key", ReloadInterval: -1},
+		},
+		{
+			name: "multiple certificates",
+			input: `custom_tls {
+				certificate /certs/a.pem /certs/a.key
+				certificate /certs/b.pem /certs/b.key
+				cert_dir /certs
+			}`,
+			want: CustomTLS{
+				Certificates: []CertKeyPair{{CertPath: "/certs/a.pem", KeyPath: "/certs/a.key"}, {CertPath: "/certs/b.pem", KeyPath: "/certs/b.key"}},
+				CertDir:      "/certs",
+			},
+		},
+		{
+			name: "key passwords",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				key_password {env.TLS_KEY_PASSWORD}
+				certificate /certs/a.pem /certs/a.key secret
+				pkcs12_file /certs/relay.pfx
+				pkcs12_password {file./run/secrets/pfx}
+			}`,
+			want: CustomTLS{
+				CertPath:       "/certs/mail.pem",
+				KeyPath:        "/certs/mail.key",
+				KeyPassword:    "{env.TLS_KEY_PASSWORD}",
+				Certificates:   []CertKeyPair{{CertPath: "/certs/a.pem", KeyPath: "/certs/a.key", KeyPassword: "secret"}},
+				PKCS12File:     "/certs/relay.pfx",
+				PKCS12Password: "{file./run/secrets/pfx}",
+			},
+		},
+		{
+			name: "expiry",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				expiry_warnings 21d 7d
+				allow_expired
+			}`,
+			want: CustomTLS{
+				CertPath:       "/certs/mail.pem",
+				KeyPath:        "/certs/mail.key",
+				ExpiryWarnings: []caddy.Duration{caddy.Duration(21 * 24 * time.Hour), caddy.Duration(7 * 24 * time.Hour)},
+				AllowExpired:   true,
+			},
+		},
+		{
+			name: "handshake limits",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				max_concurrent_handshakes 64
+				handshake_queue_timeout 2s
+				handshake_timeout off
+				client_hello_timeout 1s
+			}`,
+			want: CustomTLS{
+				CertPath:                "/certs/mail.pem",
+				KeyPath:                 "/certs/mail.key",
+				MaxConcurrentHandshakes: 64,
+				HandshakeQueueTimeout:   caddy.Duration(2 * time.Second),
+				HandshakeTimeout:        -1,
+				ClientHelloTimeout:      caddy.Duration(time.Second),
+			},
+		},
+		{
+			name: "tls settings",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				profile intermediate
+				protocols tls1.2 tls1.3
+				ciphers TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+				curves x25519mlkem768 x25519
+				alpn smtp
+			}`,
+			want: CustomTLS{
+				CertPath:     "/certs/mail.pem",
+				KeyPath:      "/certs/mail.key",
+				Profile:      "intermediate",
+				ProtocolMin:  "tls1.2",
+				ProtocolMax:  "tls1.3",
+				CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+				Curves:       []string{"x25519mlkem768", "x25519"},
+				ALPN:         []string{"smtp"},
+			},
+		},
+		{
+			name: "ocsp",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				ocsp {
+					cache_dir /var/lib/ocsp
+					refuse_revoked
+				}
+			}`,
+			want: CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key", OCSP: &OCSPStapling{CacheDir: "/var/lib/ocsp", RefuseRevoked: true}},
+		},
+		{
+			name: "ocsp off",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				ocsp off
+			}`,
+			want: CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key", OCSP: &OCSPStapling{Disabled: true}},
+		},
+		{
+			name: "session tickets",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				session_tickets {
+					storage
+					rotation_interval 6h
+				}
+			}`,
+			want: CustomTLS{
+				CertPath:       "/certs/mail.pem",
+				KeyPath:        "/certs/mail.key",
+				SessionTickets: &SessionTickets{Storage: true, RotationInterval: caddy.Duration(6 * time.Hour)},
+			},
+		},
+		{
+			name: "ech",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				ech ech.example.com {
+					publish_file /var/lib/caddy/ech.b64
+				}
+			}`,
+			want: CustomTLS{CertPath: "/certs/mail.pem", KeyPath: "/certs/mail.key", ECH: &ECH{PublicName: "ech.example.com", PublishFile: "/var/lib/caddy/ech.b64"}},
+		},
+		{
+			name: "protocols without arguments",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				protocols
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "certificate without key",
+			input: `custom_tls {
+				certificate /certs/a.pem
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "negative max_concurrent_handshakes",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				max_concurrent_handshakes -1
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "invalid reload interval",
+			input: `custom_tls /certs/mail.pem /certs/mail.key {
+				reload_interval soon
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c CustomTLS
+			err := c.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("UnmarshalCaddyfile() = %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package caddystarttls
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long established sessions may continue after
+// the handler was cleaned up, e.g. by a config reload, before they are closed.
+const defaultDrainTimeout = 10 * time.Second
+
+// connTracker keeps track of live client connections so that a handler
+// can drain them when it is cleaned up. The zero value is ready to use.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	idle     chan struct{} // Closed once draining and no connections are left
+}
+
+// add starts tracking conn. It reports false if the handler is draining
+// and should not accept new work.
+func (t *connTracker) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+// remove stops tracking conn.
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	if t.draining && len(t.conns) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// isDraining reports whether drain has been called.
+func (t *connTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops accepting new connections and returns the ones still tracked,
+// together with a channel that is closed once all of them were removed.
+func (t *connTracker) drain() ([]net.Conn, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+
+	idle := make(chan struct{})
+	if len(t.conns) == 0 {
+		close(idle)
+	} else {
+		t.idle = idle
+	}
+
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	return conns, idle
+}
+
+// writeShuttingDown tells a client that the service is going away.
+func writeShuttingDown(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("421 4.3.2 Service shutting down, closing transmission channel\r\n"))
+}
@@ -0,0 +1,442 @@
+package caddystarttls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	// defaultECHRotationInterval is how often a new ECH key is generated.
+	defaultECHRotationInterval = 30 * 24 * time.Hour
+	// defaultECHMaxKeys is how many ECH keys are kept: the published one,
+	// and the previous one for clients with a cached HTTPS record.
+	defaultECHMaxKeys = 2
+	// echKeyCheckInterval is how often ECH keys are checked for rotation
+	// and for changes made by other nodes or to the key files.
+	echKeyCheckInterval = 10 * time.Minute
+	// echKeysStoragePrefix is where shared keys are kept in Caddy's
+	// storage, per public name.
+	echKeysStoragePrefix = "custom_tls/ech_keys"
+)
+
+// Protocol identifiers of the ECH configs generated here, see RFC 9180 and
+// draft-ietf-tls-esni.
+const (
+	echConfigVersion  = 0xfe0d
+	hpkeKEMX25519     = 0x0020
+	hpkeKDFHKDFSHA256 = 0x0001
+)
+
+// hpkeAEADs are the AEADs offered in generated ECH configs: AES-128-GCM,
+// AES-256-GCM and ChaCha20Poly1305.
+var hpkeAEADs = []uint16{0x0001, 0x0002, 0x0003}
+
+// ECH configures Encrypted Client Hello, which hides the server name a
+// client connects to behind the public name. Clients get the ECH config
+// list from the ech parameter of the HTTPS DNS record, e.g.
+//
+//	internal.example.com. HTTPS 1 . ech=<base64 ECH config list>
+//
+// Connections accepted with ECH are handled with the inner server name.
+type ECH struct {
+	// Server name clients send in the clear. A certificate for it is needed
+	// for clients to recover from stale ECH configs. Required unless
+	// key_files are used.
+	PublicName string `json:"public_name,omitempty"`
+
+	// Files with an ECH key in the PEM format of OpenSSL: a PKCS#8 X25519
+	// PRIVATE KEY block and an ECHCONFIG block with its ECH config list.
+	// The first key is the published one. Keys are not generated or
+	// rotated when key files are used; files are re-read when they change.
+	// Without key files, keys are generated and kept in Caddy's storage, so
+	// that they survive config reloads and are shared by all nodes using
+	// the same storage.
+	KeyFiles []string `json:"key_files,omitempty"`
+
+	// How often a new key is generated. Default: 30d.
+	RotationInterval caddy.Duration `json:"rotation_interval,omitempty"`
+
+	// Number of keys to keep, including the published one. Keep the
+	// rotation interval well above the HTTPS record's TTL, so that clients
+	// never hold a config for a key that was already dropped. Default: 2.
+	MaxKeys int `json:"max_keys,omitempty"`
+
+	// File the current ECH config list is written to, base64-encoded as
+	// for the ech parameter of an HTTPS record, whenever it changes.
+	PublishFile string `json:"publish_file,omitempty"`
+
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	// Keys handshakes decrypt ClientHellos with.
+	serverKeys atomic.Pointer[[]tls.EncryptedClientHelloKey]
+
+	// Only touched by the initial update and the maintenance goroutine.
+	keys      []echKey
+	created   time.Time // When the newest stored key was added
+	fileData  [][]byte
+	published string
+}
+
+// echKey is an ECH key, newest first in ECH.keys, as kept in storage.
+type echKey struct {
+	Config     []byte `json:"config"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+// provision validates the options and applies their defaults.
+func (e *ECH) provision(ctx caddy.Context, logger *zap.Logger) error {
+	e.logger = logger
+	if len(e.KeyFiles) > 0 {
+		return nil
+	}
+	if e.PublicName == "" {
+		return fmt.Errorf("ech: public_name or key_files required")
+	}
+	if len(e.PublicName) > 255 || net.ParseIP(e.PublicName) != nil || strings.Contains(e.PublicName, "*") ||
+		!certmagic.SubjectQualifiesForCert(e.PublicName) {
+		return fmt.Errorf("ech: invalid public_name: %s", e.PublicName)
+	}
+	if e.RotationInterval <= 0 {
+		e.RotationInterval = caddy.Duration(defaultECHRotationInterval)
+	}
+	if e.MaxKeys <= 0 {
+		e.MaxKeys = defaultECHMaxKeys
+	}
+	if e.storage == nil {
+		e.storage = ctx.Storage()
+	}
+	return nil
+}
+
+// configure sets up cfg to accept ECH with the initial keys.
+func (e *ECH) configure(ctx context.Context, cfg *tls.Config) error {
+	if err := e.update(ctx); err != nil {
+		return err
+	}
+	cfg.GetEncryptedClientHelloKeys = func(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+		return *e.serverKeys.Load(), nil
+	}
+	return nil
+}
+
+// update loads or rotates the keys as due and publishes the config list of
+// the current key if it changed.
+func (e *ECH) update(ctx context.Context) error {
+	var changed bool
+	var err error
+	if len(e.KeyFiles) > 0 {
+		changed, err = e.loadKeyFiles()
+	} else {
+		changed, err = e.syncStorage(ctx)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	serverKeys := make([]tls.EncryptedClientHelloKey, len(e.keys))
+	for i, k := range e.keys {
+		serverKeys[i] = tls.EncryptedClientHelloKey{Config: k.Config, PrivateKey: k.PrivateKey, SendAsRetry: i == 0}
+	}
+	e.serverKeys.Store(&serverKeys)
+	return e.publish(marshalECHConfigList(e.keys[0].Config))
+}
+
+// publish logs the ECH config list and writes it to the publish file if it
+// changed.
+func (e *ECH) publish(list []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(list)
+	if encoded == e.published {
+		return nil
+	}
+	if e.PublishFile != "" {
+		tmp := e.PublishFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(encoded+"\n"), 0o644); err != nil {
+			return fmt.Errorf("ech: writing publish_file: %v", err)
+		}
+		if err := os.Rename(tmp, e.PublishFile); err != nil {
+			return fmt.Errorf("ech: writing publish_file: %v", err)
+		}
+	}
+	e.published = encoded
+	e.logger.Info("ECH config list changed; publish it in the HTTPS record",
+		zap.String("public_name", e.PublicName),
+		zap.String("ech_config_list", encoded))
+	return nil
+}
+
+// loadKeyFiles reads the key files if any of them changed since the last
+// call.
+func (e *ECH) loadKeyFiles() (bool, error) {
+	data := make([][]byte, len(e.KeyFiles))
+	changed := len(e.fileData) != len(data)
+	for i, name := range e.KeyFiles {
+		var err error
+		if data[i], err = os.ReadFile(name); err != nil {
+			return false, fmt.Errorf("ech: %v", err)
+		}
+		changed = changed || !bytes.Equal(data[i], e.fileData[i])
+	}
+	if !changed {
+		return false, nil
+	}
+
+	keys := make([]echKey, len(data))
+	for i, d := range data {
+		var err error
+		if keys[i], err = parseECHKeyFile(d); err != nil {
+			return false, fmt.Errorf("ech: %s: %v", e.KeyFiles[i], err)
+		}
+	}
+	e.keys, e.fileData = keys, data
+	return true, nil
+}
+
+// storageKey returns where the keys for the public name are stored.
+func (e *ECH) storageKey() string {
+	return echKeysStoragePrefix + "/" + certmagic.StorageKeys.Safe(e.PublicName) + ".json"
+}
+
+// syncStorage loads the shared keys and rotates them if they are due.
+func (e *ECH) syncStorage(ctx context.Context) (bool, error) {
+	stored, err := keyRotation[echKey]{
+		storage:  e.storage,
+		key:      e.storageKey(),
+		interval: time.Duration(e.RotationInterval),
+		maxKeys:  e.MaxKeys,
+		generate: func(existing []echKey) (echKey, error) {
+			return generateECHKey(e.PublicName, existing)
+		},
+	}.sync(ctx)
+	if err != nil {
+		return false, fmt.Errorf("ech: %v", err)
+	}
+
+	if stored.Created.Equal(e.created) && len(stored.Keys) == len(e.keys) {
+		return false, nil
+	}
+	e.keys, e.created = stored.Keys, stored.Created
+	return true, nil
+}
+
+// generateECHKey generates an X25519 key for an ECH config with the public
+// name. Its config ID differs from those of the existing keys, so clients
+// with an older config are matched to its key.
+func generateECHKey(publicName string, existing []echKey) (echKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return echKey{}, err
+	}
+	var id [1]byte
+	for taken := true; taken; {
+		rand.Read(id[:])
+		taken = false
+		for _, k := range existing {
+			// The ID follows the version and length of the config.
+			if k.Config[4] == id[0] {
+				taken = true
+			}
+		}
+	}
+	config, err := marshalECHConfig(id[0], priv.PublicKey().Bytes(), publicName)
+	if err != nil {
+		return echKey{}, err
+	}
+	return echKey{Config: config, PrivateKey: priv.Bytes()}, nil
+}
+
+// marshalECHConfig encodes an ECHConfig with the X25519 public key.
+func marshalECHConfig(id uint8, publicKey []byte, publicName string) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(hpkeKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range hpkeAEADs {
+				b.AddUint16(hpkeKDFHKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+		b.AddUint8(0) // maximum_name_length: let clients pad as they see fit
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	return b.Bytes()
+}
+
+// marshalECHConfigList encodes ECHConfigs as an ECHConfigList.
+func marshalECHConfigList(configs ...[]byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, c := range configs {
+			b.AddBytes(c)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// parseECHConfigList splits an ECHConfigList into its ECHConfigs.
+func parseECHConfigList(data []byte) ([][]byte, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, fmt.Errorf("malformed ECH config list")
+	}
+	var configs [][]byte
+	for !list.Empty() {
+		start := list
+		var version uint16
+		var body cryptobyte.String
+		if !list.ReadUint16(&version) || !list.ReadUint16LengthPrefixed(&body) {
+			return nil, fmt.Errorf("malformed ECH config list")
+		}
+		configs = append(configs, start[:len(start)-len(list)])
+	}
+	return configs, nil
+}
+
+// parseECHConfig returns the KEM and public key of an ECHConfig.
+func parseECHConfig(config []byte) (kem uint16, publicKey []byte, err error) {
+	s := cryptobyte.String(config)
+	var version, length uint16
+	var id uint8
+	var pub cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadUint16(&length) || int(length) != len(s) {
+		return 0, nil, fmt.Errorf("malformed ECH config")
+	}
+	if version != echConfigVersion {
+		return 0, nil, fmt.Errorf("unsupported ECH config version %#04x", version)
+	}
+	if !s.ReadUint8(&id) || !s.ReadUint16(&kem) || !s.ReadUint16LengthPrefixed(&pub) {
+		return 0, nil, fmt.Errorf("malformed ECH config")
+	}
+	return kem, pub, nil
+}
+
+// parseECHKeyFile parses an ECH key in the PEM format of OpenSSL. Only
+// X25519 keys are supported.
+func parseECHKeyFile(data []byte) (echKey, error) {
+	var key echKey
+	var publicKey, list []byte
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return key, err
+			}
+			priv, ok := k.(*ecdh.PrivateKey)
+			if !ok || priv.Curve() != ecdh.X25519() {
+				return key, fmt.Errorf("private key is not an X25519 key")
+			}
+			key.PrivateKey, publicKey = priv.Bytes(), priv.PublicKey().Bytes()
+		case "ECHCONFIG":
+			list = block.Bytes
+		}
+	}
+	if key.PrivateKey == nil || list == nil {
+		return key, fmt.Errorf("PRIVATE KEY or ECHCONFIG block missing")
+	}
+
+	configs, err := parseECHConfigList(list)
+	if err != nil {
+		return key, err
+	}
+	for _, config := range configs {
+		kem, pub, err := parseECHConfig(config)
+		if err == nil && kem == hpkeKEMX25519 && bytes.Equal(pub, publicKey) {
+			key.Config = config
+			return key, nil
+		}
+	}
+	return key, fmt.Errorf("no ECH config for the private key")
+}
+
+// unmarshalCaddyfile parses an ech block:
+//
+//	ech [<public_name>] {
+//		public_name <name>
+//		key_file <path>
+//		rotation_interval <duration>
+//		max_keys <n>
+//		publish_file <path>
+//	}
+//
+// key_file may be given more than once, the published key first.
+func (e *ECH) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		e.PublicName = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "public_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			e.PublicName = d.Val()
+		case "key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			e.KeyFiles = append(e.KeyFiles, d.Val())
+		case "rotation_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid rotation_interval: %v", err)
+			}
+			e.RotationInterval = caddy.Duration(dur)
+		case "max_keys":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxKeys, err := strconv.Atoi(d.Val())
+			if err != nil || maxKeys < 1 {
+				return d.Errf("invalid max_keys: %s", d.Val())
+			}
+			e.MaxKeys = maxKeys
+		case "publish_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			e.PublishFile = d.Val()
+		default:
+			return d.Errf("unrecognized ech option: %s", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package caddystarttls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// newECHTestServer returns a CustomTLS serving ech.example.com as the ECH
+// public name and secret.example.com behind it. Generated keys are kept in
+// a storage of their own unless ech has one.
+func newECHTestServer(t *testing.T, ech *ECH) *CustomTLS {
+	t.Helper()
+	if len(ech.KeyFiles) == 0 && ech.storage == nil {
+		ech.storage = &certmagic.FileStorage{Path: t.TempDir()}
+	}
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "public", newTestCertificate(t, "ech.example.com"))
+	secretCert, secretKey := writeTestKeyPair(t, dir, "secret", newTestCertificate(t, "secret.example.com"))
+	c := &CustomTLS{
+		CertPath:       certPath,
+		KeyPath:        keyPath,
+		Certificates:   []CertKeyPair{{CertPath: secretCert, KeyPath: secretKey}},
+		ECH:            ech,
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, c)
+	return c
+}
+
+// echClientConfig returns a client config connecting to secret.example.com
+// with the ECH config list.
+func echClientConfig(list []byte) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify:             true,
+		ServerName:                     "secret.example.com",
+		EncryptedClientHelloConfigList: list,
+	}
+}
+
+// publishedECHConfigList returns the ECH config list c publishes.
+func publishedECHConfigList(t *testing.T, c *CustomTLS) []byte {
+	t.Helper()
+	list, err := base64.StdEncoding.DecodeString(c.ECH.published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestCustomTLSECH(t *testing.T) {
+	publishFile := filepath.Join(t.TempDir(), "ech.b64")
+	c := newECHTestServer(t, &ECH{PublicName: "ech.example.com", PublishFile: publishFile})
+
+	published, err := os.ReadFile(publishFile)
+	if err != nil {
+		t.Fatalf("publish_file not written: %v", err)
+	}
+	if got := strings.TrimSpace(string(published)); got != c.ECH.published {
+		t.Errorf("publish_file = %q, want %q", got, c.ECH.published)
+	}
+
+	state, nextCx, err := handshakeCustomTLS(t, c, echClientConfig(publishedECHConfigList(t, c)))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if !state.ECHAccepted {
+		t.Error("ECH not accepted")
+	}
+	if got := state.PeerCertificates[0].DNSNames[0]; got != "secret.example.com" {
+		t.Errorf("served certificate for %s, want secret.example.com", got)
+	}
+	if nextCx == nil {
+		t.Fatal("next handler not called")
+	}
+
+	// A client with a config for unknown keys is rejected and handed the
+	// current config list to retry with.
+	other := newECHTestServer(t, &ECH{PublicName: "ech.example.com"})
+	err = echClientHandshake(t, c, publishedECHConfigList(t, other))
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("handshake with unknown ECH keys: error = %v, want ECH rejection", err)
+	}
+	if !bytes.Equal(rejection.RetryConfigList, publishedECHConfigList(t, c)) {
+		t.Error("retry configs are not the published config list")
+	}
+}
+
+// echClientHandshake runs c.Handle against a client trusting the public
+// name's certificate and returns the client's handshake error. Unlike
+// handshakeCustomTLS, it lets the client verify the certificate presented
+// when ECH is rejected, which it does before it trusts the retry configs.
+func echClientHandshake(t *testing.T, c *CustomTLS, list []byte) error {
+	t.Helper()
+	publicCert, err := os.ReadFile(c.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := echClientConfig(list)
+	cfg.RootCAs = x509.NewCertPool()
+	cfg.RootCAs.AppendCertsFromPEM(publicCert)
+
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverEnd.Close()
+		c.Handle(layer4.WrapConnection(serverEnd, nil, nil), layer4.HandlerFunc(func(*layer4.Connection) error { return nil }))
+	}()
+	err = tls.Client(clientEnd, cfg).Handshake()
+	clientEnd.Close()
+	<-done
+	return err
+}
+
+func TestCustomTLSECHRotation(t *testing.T) {
+	c := newECHTestServer(t, &ECH{PublicName: "ech.example.com"})
+	old := publishedECHConfigList(t, c)
+
+	c.ECH.RotationInterval = caddy.Duration(time.Nanosecond)
+	if err := c.ECH.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	current := publishedECHConfigList(t, c)
+	if bytes.Equal(current, old) {
+		t.Fatal("config list not rotated")
+	}
+
+	// Clients with a cached config of the previous key still get through.
+	for name, list := range map[string][]byte{"current": current, "previous": old} {
+		state, _, err := handshakeCustomTLS(t, c, echClientConfig(list))
+		if err != nil || !state.ECHAccepted {
+			t.Errorf("%s config: ECH accepted = %v, error = %v", name, state.ECHAccepted, err)
+		}
+	}
+
+	// Keys beyond max_keys are dropped.
+	if err := c.ECH.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var rejection *tls.ECHRejectionError
+	if err := echClientHandshake(t, c, old); !errors.As(err, &rejection) {
+		t.Errorf("config of a dropped key: error = %v, want ECH rejection", err)
+	}
+}
+
+func TestCustomTLSECHStorage(t *testing.T) {
+	// A config reload provisions a new handler, as does another node
+	// sharing the storage. Both must keep the published config list.
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	nodes := []*CustomTLS{
+		newECHTestServer(t, &ECH{PublicName: "ech.example.com", storage: storage}),
+		newECHTestServer(t, &ECH{PublicName: "ech.example.com", storage: storage}),
+	}
+	list := publishedECHConfigList(t, nodes[0])
+	if !bytes.Equal(publishedECHConfigList(t, nodes[1]), list) {
+		t.Fatal("handlers sharing storage publish different config lists")
+	}
+	state, _, err := handshakeCustomTLS(t, nodes[1], echClientConfig(list))
+	if err != nil || !state.ECHAccepted {
+		t.Errorf("ECH accepted = %v, error = %v on the other node", state.ECHAccepted, err)
+	}
+}
+
+// writeECHKeyFile writes an ECH key in the PEM format of OpenSSL.
+func writeECHKeyFile(t *testing.T, path, publicName string) []byte {
+	t.Helper()
+	key, err := generateECHKey(publicName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := marshalECHConfigList(key.Config)
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: list})...)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestCustomTLSECHKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	current := writeECHKeyFile(t, filepath.Join(dir, "current.pem"), "ech.example.com")
+	previous := writeECHKeyFile(t, filepath.Join(dir, "previous.pem"), "ech.example.com")
+	c := newECHTestServer(t, &ECH{KeyFiles: []string{filepath.Join(dir, "current.pem"), filepath.Join(dir, "previous.pem")}})
+
+	if !bytes.Equal(publishedECHConfigList(t, c), current) {
+		t.Error("published config list is not the first key file's")
+	}
+	for name, list := range map[string][]byte{"current": current, "previous": previous} {
+		state, _, err := handshakeCustomTLS(t, c, echClientConfig(list))
+		if err != nil || !state.ECHAccepted {
+			t.Errorf("%s key: ECH accepted = %v, error = %v", name, state.ECHAccepted, err)
+		}
+	}
+
+	// A replaced key file is picked up.
+	replaced := writeECHKeyFile(t, filepath.Join(dir, "current.pem"), "ech.example.com")
+	if err := c.ECH.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(publishedECHConfigList(t, c), replaced) {
+		t.Error("replaced key file not picked up")
+	}
+}
+
+func TestParseECHKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ech.pem")
+	writeECHKeyFile(t, path, "ech.example.com")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, rest := pem.Decode(data)
+	configBlock, _ := pem.Decode(rest)
+	otherList := marshalECHConfigList(mustGenerateECHKey(t).Config)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"valid", data, ""},
+		{"without config", pem.EncodeToMemory(keyBlock), "block missing"},
+		{"without key", pem.EncodeToMemory(configBlock), "block missing"},
+		{
+			name:    "config for another key",
+			data:    append(pem.EncodeToMemory(keyBlock), pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: otherList})...),
+			wantErr: "no ECH config for the private key",
+		},
+		{
+			name:    "malformed config list",
+			data:    append(pem.EncodeToMemory(keyBlock), pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: []byte{0, 9, 1}})...),
+			wantErr: "malformed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseECHKeyFile(tt.data)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parseECHKeyFile() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseECHKeyFile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustGenerateECHKey(t *testing.T) echKey {
+	t.Helper()
+	key, err := generateECHKey("ech.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCustomTLSECHRequiresTLS13(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "ech.example.com"))
+	c := &CustomTLS{
+		CertPath:       certPath,
+		KeyPath:        keyPath,
+		ProtocolMax:    "tls1.2",
+		ECH:            &ECH{PublicName: "ech.example.com", storage: &certmagic.FileStorage{Path: t.TempDir()}},
+		ReloadInterval: -1,
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := c.Provision(ctx); err == nil {
+		t.Error("Provision() succeeded with ech and TLS 1.2 at most")
+	}
+}
+
+func TestECHProvisionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ech  *ECH
+	}{
+		{"no public name", &ECH{}},
+		{"IP public name", &ECH{PublicName: "192.0.2.1"}},
+		{"wildcard public name", &ECH{PublicName: "*.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := tt.ech.provision(ctx, ctx.Logger()); err == nil {
+				t.Error("provision() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestECHUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    *ECH
+		wantErr bool
+	}{
+		{
+			name:  "public name",
+			input: `ech ech.example.com`,
+			want:  &ECH{PublicName: "ech.example.com"},
+		},
+		{
+			name: "rotation",
+			input: `ech {
+				public_name ech.example.com
+				rotation_interval 168h
+				max_keys 3
+				publish_file /var/lib/caddy/ech.b64
+			}`,
+			want: &ECH{
+				PublicName:       "ech.example.com",
+				RotationInterval: caddy.Duration(168 * time.Hour),
+				MaxKeys:          3,
+				PublishFile:      "/var/lib/caddy/ech.b64",
+			},
+		},
+		{
+			name: "key files",
+			input: `ech {
+				key_file /etc/caddy/ech/current.pem
+				key_file /etc/caddy/ech/previous.pem
+			}`,
+			want: &ECH{KeyFiles: []string{"/etc/caddy/ech/current.pem", "/etc/caddy/ech/previous.pem"}},
+		},
+		{name: "two public names", input: `ech a.example.com b.example.com`, wantErr: true},
+		{
+			name: "unknown option",
+			input: `ech ech.example.com {
+				outer_sni ech.example.com
+			}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			d.Next()
+			e := new(ECH)
+			err := e.unmarshalCaddyfile(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(e, tt.want) {
+				t.Errorf("unmarshalCaddyfile() = %+v, want %+v", e, tt.want)
+			}
+		})
+	}
+}
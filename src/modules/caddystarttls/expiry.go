@@ -0,0 +1,115 @@
+package caddystarttls
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// expiryCheckInterval is how often certificate expiry is checked.
+const expiryCheckInterval = time.Hour
+
+// defaultExpiryWarnings are the remaining lifetimes at which a warning is
+// logged for a certificate about to expire.
+var defaultExpiryWarnings = []caddy.Duration{
+	caddy.Duration(30 * 24 * time.Hour),
+	caddy.Duration(14 * 24 * time.Hour),
+	caddy.Duration(3 * 24 * time.Hour),
+}
+
+// checkExpired returns an error for the first of the explicitly configured
+// files that has already expired, unless expired certificates are allowed.
+func (c *CustomTLS) checkExpired(files []*certFile, now time.Time) error {
+	if c.AllowExpired {
+		return nil
+	}
+	for _, f := range files {
+		cert := f.cert.Load()
+		if cert != nil && cert.Leaf != nil && now.After(cert.Leaf.NotAfter) {
+			return fmt.Errorf("certificate %s expired at %s; set allow_expired to serve it anyway",
+				f.certPath, cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// excludeExpiredDirPairs leaves expired certificates found in cert_dir out of
+// the index, unless expired certificates are allowed. Like pairs that fail to
+// load, they are logged instead of failing the whole handler. It reports
+// whether a pair was excluded or taken back in, so that the index needs to
+// be rebuilt.
+func (c *CustomTLS) excludeExpiredDirPairs(now time.Time) bool {
+	changed := false
+	for _, f := range c.certs.dirPairs {
+		cert := f.cert.Load()
+		expired := !c.AllowExpired && cert != nil && cert.Leaf != nil && now.After(cert.Leaf.NotAfter)
+		if expired == f.expired {
+			continue
+		}
+		if expired {
+			c.logger.Warn("skipping expired certificate in cert_dir",
+				zap.String("cert_path", f.certPath),
+				zap.Time("not_after", cert.Leaf.NotAfter))
+		}
+		f.expired = expired
+		changed = true
+	}
+	return changed
+}
+
+// checkExpiry publishes the expiry of files as metrics and logs a warning
+// when a certificate crosses one of the expiry_warnings thresholds, and an
+// error once it has expired. Each level is logged once per certificate.
+func (c *CustomTLS) checkExpiry(files []*certFile, now time.Time) {
+	current := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		cert := f.cert.Load()
+		if cert == nil || cert.Leaf == nil {
+			continue
+		}
+		current[f.certPath] = struct{}{}
+		certificateExpiry.WithLabelValues(f.certPath).Set(float64(cert.Leaf.NotAfter.Unix()))
+
+		remaining := cert.Leaf.NotAfter.Sub(now)
+		level := expiryLevel(remaining, c.ExpiryWarnings)
+		if level <= f.expiryLevel {
+			continue
+		}
+		f.expiryLevel = level
+		fields := []zap.Field{
+			zap.String("cert_path", f.certPath),
+			zap.Strings("names", cert.Leaf.DNSNames),
+			zap.Time("not_after", cert.Leaf.NotAfter),
+		}
+		if remaining <= 0 {
+			c.logger.Error("certificate has expired", fields...)
+			continue
+		}
+		c.logger.Warn("certificate expires soon", append(fields, zap.Duration("expires_in", remaining))...)
+	}
+
+	// Files removed from cert_dir no longer have an expiry.
+	for path := range c.expiryReported {
+		if _, ok := current[path]; !ok {
+			certificateExpiry.DeleteLabelValues(path)
+		}
+	}
+	c.expiryReported = current
+}
+
+// expiryLevel returns how many of thresholds a certificate with the given
+// remaining lifetime has crossed, plus one if it has expired.
+func expiryLevel(remaining time.Duration, thresholds []caddy.Duration) int {
+	level := 0
+	for _, t := range thresholds {
+		if remaining <= time.Duration(t) {
+			level++
+		}
+	}
+	if remaining <= 0 {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,103 @@
+package caddystarttls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestExpiryLevel(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		remaining time.Duration
+		want      int
+	}{
+		{60 * day, 0},
+		{30 * day, 1},
+		{20 * day, 1},
+		{10 * day, 2},
+		{2 * day, 3},
+		{-time.Minute, 4},
+	}
+	for _, tt := range tests {
+		if got := expiryLevel(tt.remaining, defaultExpiryWarnings); got != tt.want {
+			t.Errorf("expiryLevel(%s) = %d, want %d", tt.remaining, got, tt.want)
+		}
+	}
+}
+
+func TestCustomTLSExpiredCertificate(t *testing.T) {
+	notAfter := time.Now().Add(-time.Hour).Truncate(time.Second)
+	certPath, keyPath := writeTestKeyPair(t, t.TempDir(), "mail", testCertOptions{names: []string{"mail.example.com"}, notAfter: notAfter}.issue(t))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1}
+	if err := c.Provision(ctx); err == nil {
+		t.Fatal("Provision() with an expired certificate succeeded")
+	}
+
+	allowed := &CustomTLS{CertPath: certPath, KeyPath: keyPath, AllowExpired: true, ReloadInterval: -1}
+	provisionCustomTLS(t, allowed)
+	if got := testutil.ToFloat64(certificateExpiry.WithLabelValues(certPath)); got != float64(notAfter.Unix()) {
+		t.Errorf("expiry metric = %v, want %d", got, notAfter.Unix())
+	}
+}
+
+func TestCustomTLSExpiredCertificateInCertDir(t *testing.T) {
+	notAfter := time.Now().Add(-time.Hour)
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "a-old", testCertOptions{names: []string{"old.example.com"}, notAfter: notAfter}.issue(t))
+
+	// An expired certificate alone in cert_dir leaves nothing to serve.
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := (&CustomTLS{CertDir: dir, ReloadInterval: -1}).Provision(ctx); err == nil {
+		t.Fatal("Provision() with only an expired certificate in cert_dir succeeded")
+	}
+
+	// Next to a valid one, it is skipped instead of failing the handler.
+	writeTestKeyPair(t, dir, "b-mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{CertDir: dir, ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+	if got := servedCertificate(t, c, "old.example.com"); got.Leaf.DNSNames[0] != "mail.example.com" {
+		t.Errorf("served %v for old.example.com, want the valid fallback", got.Leaf.DNSNames)
+	}
+
+	allowed := &CustomTLS{CertDir: dir, AllowExpired: true, ReloadInterval: -1}
+	provisionCustomTLS(t, allowed)
+	if got := servedCertificate(t, allowed, "old.example.com"); got.Leaf.DNSNames[0] != "old.example.com" {
+		t.Errorf("served %v for old.example.com with allow_expired, want the expired certificate", got.Leaf.DNSNames)
+	}
+}
+
+func TestCustomTLSExpiryWarnings(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", testCertOptions{names: []string{"mail.example.com"}, notAfter: time.Now().Add(20 * 24 * time.Hour)}.issue(t))
+
+	core, logs := observer.New(zap.WarnLevel)
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, OCSP: &OCSPStapling{Disabled: true}}
+	provisionCustomTLS(t, c)
+	c.logger = zap.New(core)
+
+	// Provision already warned about the 30 day threshold.
+	now := time.Now()
+	c.checkExpiry(c.certs.files(), now)
+	if n := logs.Len(); n != 0 {
+		t.Fatalf("threshold logged again: %v", logs.All())
+	}
+	c.checkExpiry(c.certs.files(), now.Add(7*24*time.Hour))
+	c.checkExpiry(c.certs.files(), now.Add(8*24*time.Hour))
+	if n := logs.FilterMessage("certificate expires soon").Len(); n != 1 {
+		t.Errorf("got %d warnings for crossing the 14 day threshold, want 1", n)
+	}
+	c.checkExpiry(c.certs.files(), now.Add(21*24*time.Hour))
+	if n := logs.FilterMessage("certificate has expired").Len(); n != 1 {
+		t.Errorf("got %d errors for the expired certificate, want 1", n)
+	}
+}
@@ -0,0 +1,112 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Reasons a handshake failed, as used in logs and the
+// tls_handshake_failures_total metric.
+const (
+	failureTimeout         = "timeout"
+	failureClientClosed    = "client_closed"
+	failureNotTLS          = "not_tls"
+	failureProtocolVersion = "protocol_version"
+	failureNoSharedCipher  = "no_shared_cipher"
+	failureNoSharedCurve   = "no_shared_curve"
+	failureNoALPN          = "no_application_protocol"
+	failureNoCertificate   = "no_certificate"
+	failureBadCertificate  = "bad_certificate"
+	failureBadClientCert   = "bad_client_certificate"
+	failureClientAlert     = "client_alert"
+	failureOther           = "other"
+)
+
+// remoteAlertPrefix starts the messages of errors caused by an alert the
+// client sent.
+const remoteAlertPrefix = "remote error: tls: "
+
+// classifyHandshakeError returns the reason a handshake failed with err.
+// crypto/tls has no error types for most failures, so they are told apart
+// by their messages.
+func classifyHandshakeError(err error) string {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return failureTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return failureClientClosed
+	case errors.As(err, &recordErr):
+		return failureNotTLS
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.HasPrefix(msg, remoteAlertPrefix):
+		// The client rejected the handshake, usually our certificate.
+		if strings.Contains(msg, "certificate") {
+			return failureBadCertificate
+		}
+		if strings.Contains(msg, "protocol version") {
+			return failureProtocolVersion
+		}
+		return failureClientAlert
+	case strings.Contains(msg, "unsupported versions"):
+		return failureProtocolVersion
+	case strings.Contains(msg, "no cipher suite supported by both"):
+		return failureNoSharedCipher
+	case strings.Contains(msg, "no ECDHE curve supported by both"):
+		return failureNoSharedCurve
+	case strings.Contains(msg, "unsupported application protocols"):
+		return failureNoALPN
+	case strings.Contains(msg, "no certificate available"):
+		return failureNoCertificate
+	case strings.Contains(msg, "client didn't provide a certificate"),
+		strings.Contains(msg, "failed to verify certificate"),
+		strings.Contains(msg, "client certificate"):
+		return failureBadClientCert
+	}
+	return failureOther
+}
+
+// logFields describes what the client offered in its ClientHello, for
+// diagnosing failed handshakes with old or unusual clients.
+func (h *clientHello) logFields() []zap.Field {
+	versions := withoutGREASE(h.supportedVersions)
+	if len(versions) == 0 {
+		versions = []uint16{h.version}
+	}
+	versionNames := make([]string, len(versions))
+	for i, v := range versions {
+		versionNames[i] = tls.VersionName(v)
+	}
+
+	ciphers := withoutGREASE(h.cipherSuites)
+	cipherNames := make([]string, len(ciphers))
+	for i, c := range ciphers {
+		cipherNames[i] = tls.CipherSuiteName(c)
+	}
+
+	curves := withoutGREASE(h.curves)
+	curveNames := make([]string, len(curves))
+	for i, c := range curves {
+		curveNames[i] = tls.CurveID(c).String()
+	}
+
+	return []zap.Field{
+		zap.String("client_hello_sni", h.serverName),
+		zap.Strings("client_hello_versions", versionNames),
+		zap.Strings("client_hello_cipher_suites", cipherNames),
+		zap.Strings("client_hello_curves", curveNames),
+		zap.Strings("client_hello_alpn", h.alpn),
+	}
+}
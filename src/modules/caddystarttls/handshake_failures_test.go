@@ -0,0 +1,103 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCustomTLSHandshakeFailures(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+
+	tests := []struct {
+		name       string
+		c          CustomTLS
+		client     *tls.Config
+		wantReason string
+	}{
+		{
+			name:       "version too low",
+			client:     &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11},
+			wantReason: failureProtocolVersion,
+		},
+		{
+			name: "no shared cipher",
+			c:    CustomTLS{Profile: "intermediate"},
+			client: &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+			},
+			wantReason: failureNoSharedCipher,
+		},
+		{
+			name:       "missing client certificate",
+			c:          CustomTLS{ClientAuth: &ClientAuth{Mode: "require"}},
+			client:     &tls.Config{InsecureSkipVerify: true},
+			wantReason: failureBadClientCert,
+		},
+		{
+			name:       "no shared application protocol",
+			c:          CustomTLS{ALPN: []string{"smtp"}},
+			client:     &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}},
+			wantReason: failureNoALPN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &tt.c
+			c.CertPath, c.KeyPath, c.ReloadInterval = certPath, keyPath, -1
+			provisionCustomTLS(t, c)
+			core, logs := observer.New(zap.ErrorLevel)
+			c.logger = zap.New(core)
+			before := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(tt.wantReason))
+
+			if _, _, err := handshakeCustomTLS(t, c, tt.client); err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			if got := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(tt.wantReason)) - before; got != 1 {
+				t.Errorf("%s failures counted %v times, want 1", tt.wantReason, got)
+			}
+			entries := logs.FilterMessage("TLS handshake failed").All()
+			if len(entries) != 1 {
+				t.Fatalf("got %d failure logs, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			if fields["reason"] != tt.wantReason {
+				t.Errorf("logged reason = %v (%v), want %s", fields["reason"], fields["error"], tt.wantReason)
+			}
+			if _, ok := fields["client_hello_cipher_suites"]; !ok {
+				t.Errorf("ClientHello not logged: %v", fields)
+			}
+		})
+	}
+}
+
+func TestClassifyHandshakeError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, failureTimeout},
+		{fmt.Errorf("read: %w", io.EOF), failureClientClosed},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, failureNotTLS},
+		{fmt.Errorf("remote error: tls: protocol version not supported"), failureProtocolVersion},
+		{fmt.Errorf("remote error: tls: bad certificate"), failureBadCertificate},
+		{fmt.Errorf("remote error: tls: handshake failure"), failureClientAlert},
+		{fmt.Errorf("tls: no ECDHE curve supported by both client and server"), failureNoSharedCurve},
+		{fmt.Errorf("no certificate available for %q", "mail.example.com"), failureNoCertificate},
+		{fmt.Errorf("tls: something new"), failureOther},
+	}
+	for _, tt := range tests {
+		if got := classifyHandshakeError(tt.err); got != tt.want {
+			t.Errorf("classifyHandshakeError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
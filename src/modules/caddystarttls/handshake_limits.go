@@ -0,0 +1,88 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+const (
+	// defaultHandshakeQueueTimeout is how long a handshake waits for a free
+	// slot when max_concurrent_handshakes are in progress.
+	defaultHandshakeQueueTimeout = 5 * time.Second
+)
+
+// errTooManyHandshakes is returned when a connection could not get a
+// handshake slot before its queue timeout.
+var errTooManyHandshakes = errors.New("too many concurrent TLS handshakes")
+
+// acquireHandshakeSlot reserves one of the max_concurrent_handshakes slots,
+// waiting up to handshake_queue_timeout for one to become free.
+func (c *CustomTLS) acquireHandshakeSlot(ctx context.Context) error {
+	if c.handshakeSlots == nil {
+		return nil
+	}
+	select {
+	case c.handshakeSlots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	tlsHandshakesQueued.Inc()
+	defer tlsHandshakesQueued.Dec()
+	timer := time.NewTimer(time.Duration(c.HandshakeQueueTimeout))
+	defer timer.Stop()
+	select {
+	case c.handshakeSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		tlsHandshakesRejected.Inc()
+		return errTooManyHandshakes
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseHandshakeSlot frees a slot reserved with acquireHandshakeSlot.
+func (c *CustomTLS) releaseHandshakeSlot() {
+	if c.handshakeSlots != nil {
+		<-c.handshakeSlots
+	}
+}
+
+// handshake runs the server handshake on conn, which reads from r, within
+// handshake_timeout. The client has client_hello_timeout to send its
+// ClientHello; a slot taken once it arrived is released when the handshake
+// is done.
+func (c *CustomTLS) handshake(ctx context.Context, r *clientHelloRecorder, conn *tls.Conn) error {
+	defer func() {
+		if r.holdsSlot {
+			c.releaseHandshakeSlot()
+		}
+	}()
+	if c.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.HandshakeTimeout))
+		defer cancel()
+	}
+	if c.ClientHelloTimeout > 0 {
+		r.SetReadDeadline(time.Now().Add(time.Duration(c.ClientHelloTimeout)))
+	}
+	return conn.HandshakeContext(ctx)
+}
+
+// clientHelloReceived is called once the ClientHello on r has been read. It
+// lifts the client_hello_timeout deadline and takes a handshake slot for the
+// rest of the handshake, so that clients which connect without sending
+// anything cannot hold slots that real handshakes wait for.
+func (c *CustomTLS) clientHelloReceived(ctx context.Context, r *clientHelloRecorder) error {
+	if c.ClientHelloTimeout > 0 {
+		r.SetReadDeadline(time.Time{})
+	}
+	if err := c.acquireHandshakeSlot(ctx); err != nil {
+		return err
+	}
+	r.holdsSlot = c.handshakeSlots != nil
+	return nil
+}
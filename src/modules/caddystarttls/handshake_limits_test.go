@@ -0,0 +1,136 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCustomTLSMaxConcurrentHandshakes(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{
+		CertPath:                certPath,
+		KeyPath:                 keyPath,
+		MaxConcurrentHandshakes: 1,
+		HandshakeQueueTimeout:   caddy.Duration(50 * time.Millisecond),
+		ReloadInterval:          -1,
+	}
+	provisionCustomTLS(t, c)
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	// Hold the only slot, as a slow client would.
+	if err := c.acquireHandshakeSlot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rejected := testutil.ToFloat64(tlsHandshakesRejected)
+	if _, _, err := handshakeCustomTLS(t, c, clientCfg); !errors.Is(err, errTooManyHandshakes) {
+		t.Fatalf("Handle() error = %v, want %v", err, errTooManyHandshakes)
+	}
+	if got := testutil.ToFloat64(tlsHandshakesRejected) - rejected; got != 1 {
+		t.Errorf("rejected handshakes counted %v times, want 1", got)
+	}
+
+	// A queued handshake proceeds once the slot is released.
+	c.HandshakeQueueTimeout = caddy.Duration(5 * time.Second)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := handshakeCustomTLS(t, c, clientCfg)
+		errc <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(tlsHandshakesQueued) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.releaseHandshakeSlot()
+	if err := <-errc; err != nil {
+		t.Fatalf("queued handshake: %v", err)
+	}
+	if got := testutil.ToFloat64(tlsHandshakesQueued); got != 0 {
+		t.Errorf("queued handshakes = %v after the queue drained", got)
+	}
+}
+
+func TestCustomTLSIdleConnectionsHoldNoSlots(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{
+		CertPath:                certPath,
+		KeyPath:                 keyPath,
+		MaxConcurrentHandshakes: 1,
+		HandshakeQueueTimeout:   caddy.Duration(50 * time.Millisecond),
+		ClientHelloTimeout:      caddy.Duration(200 * time.Millisecond),
+		ReloadInterval:          -1,
+	}
+	provisionCustomTLS(t, c)
+	next := layer4.HandlerFunc(func(*layer4.Connection) error { return nil })
+
+	// Clients that connect but never send a ClientHello.
+	timeouts := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(failureTimeout))
+	errc := make(chan error, 3)
+	for range cap(errc) {
+		clientEnd, serverEnd := net.Pipe()
+		defer clientEnd.Close()
+		go func() { errc <- c.Handle(layer4.WrapConnection(serverEnd, nil, nil), next) }()
+	}
+
+	// A real handshake still gets the only slot.
+	if _, _, err := handshakeCustomTLS(t, c, &tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("handshake next to idle connections: %v", err)
+	}
+
+	for range cap(errc) {
+		if err := <-errc; err == nil {
+			t.Error("idle connection handled without a ClientHello")
+		}
+	}
+	if got := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(failureTimeout)) - timeouts; got != 3 {
+		t.Errorf("timeouts counted %v times, want 3", got)
+	}
+}
+
+func TestCustomTLSHandshakeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, HandshakeTimeout: caddy.Duration(50 * time.Millisecond), ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+
+	// The client connects but never sends a ClientHello.
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	timeouts := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(failureTimeout))
+	next := layer4.HandlerFunc(func(*layer4.Connection) error { return nil })
+
+	start := time.Now()
+	if err := c.Handle(layer4.WrapConnection(serverEnd, nil, nil), next); err == nil {
+		t.Fatal("Handle() succeeded without a ClientHello")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handshake took %s despite a 50ms timeout", elapsed)
+	}
+	if got := testutil.ToFloat64(tlsHandshakeFailures.WithLabelValues(failureTimeout)) - timeouts; got != 1 {
+		t.Errorf("timeouts counted %v times, want 1", got)
+	}
+}
+
+func TestCustomTLSHandshakeTimeoutsDisabledByDefault(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+
+	// Existing configs keep handshakes bounded only by the connection.
+	if c.HandshakeTimeout != 0 || c.ClientHelloTimeout != 0 {
+		t.Errorf("expected no timeouts unless configured, got handshake_timeout %v and client_hello_timeout %v",
+			time.Duration(c.HandshakeTimeout), time.Duration(c.ClientHelloTimeout))
+	}
+}
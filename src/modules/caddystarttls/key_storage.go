@@ -0,0 +1,93 @@
+package caddystarttls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// storedKeys is how rotated keys are kept in Caddy's storage, newest first.
+type storedKeys[K any] struct {
+	Keys    []K       `json:"keys"`
+	Created time.Time `json:"created"` // When the newest key was added
+}
+
+// keyRotation rotates keys kept in Caddy's storage, so that all nodes using
+// the same storage share the keys. The rotation happens under a storage
+// lock, so that only one node rotates.
+type keyRotation[K any] struct {
+	storage  certmagic.Storage
+	key      string // Storage key
+	interval time.Duration
+	maxKeys  int
+
+	// generate returns a new key to add before the existing ones.
+	generate func(existing []K) (K, error)
+}
+
+// sync loads the stored keys and rotates them first if they are due.
+func (r keyRotation[K]) sync(ctx context.Context) (*storedKeys[K], error) {
+	stored, err := r.load(ctx)
+	if err != nil || !r.due(stored) {
+		return stored, err
+	}
+	if err := r.storage.Lock(ctx, r.key); err != nil {
+		return nil, fmt.Errorf("locking storage: %v", err)
+	}
+	defer r.storage.Unlock(ctx, r.key)
+	// Another node may have rotated the keys while we waited for the lock.
+	if stored, err = r.load(ctx); err != nil || !r.due(stored) {
+		return stored, err
+	}
+	return r.storeRotated(ctx, stored)
+}
+
+// due reports whether stored, which may be nil, needs a new key.
+func (r keyRotation[K]) due(stored *storedKeys[K]) bool {
+	return stored == nil || time.Since(stored.Created) >= r.interval
+}
+
+// load returns the keys in storage, or nil if there are none yet.
+func (r keyRotation[K]) load(ctx context.Context) (*storedKeys[K], error) {
+	data, err := r.storage.Load(ctx, r.key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading keys: %v", err)
+	}
+	stored := new(storedKeys[K])
+	if err := json.Unmarshal(data, stored); err != nil || len(stored.Keys) == 0 {
+		return nil, fmt.Errorf("invalid keys in storage")
+	}
+	return stored, nil
+}
+
+// storeRotated adds a new key to stored, which may be nil, and saves it.
+func (r keyRotation[K]) storeRotated(ctx context.Context, stored *storedKeys[K]) (*storedKeys[K], error) {
+	var existing []K
+	if stored != nil {
+		existing = stored.Keys
+	}
+	key, err := r.generate(existing)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %v", err)
+	}
+	rotated := &storedKeys[K]{Keys: append([]K{key}, existing...), Created: time.Now()}
+	if len(rotated.Keys) > r.maxKeys {
+		rotated.Keys = rotated.Keys[:r.maxKeys]
+	}
+	data, err := json.Marshal(rotated)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.Store(ctx, r.key, data); err != nil {
+		return nil, fmt.Errorf("storing keys: %v", err)
+	}
+	return rotated, nil
+}
@@ -0,0 +1,73 @@
+package caddystarttls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// parseKeyPair parses a PEM certificate chain and its private key. A key in
+// an "ENCRYPTED PRIVATE KEY" block (PKCS#8) is decrypted with password.
+func parseKeyPair(certPEM, keyPEM []byte, password string) (tls.Certificate, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if password == "" {
+		return tls.Certificate{}, fmt.Errorf("private key is encrypted but no key_password is set")
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("decrypting private key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// parsePKCS12 parses a PKCS#12 (.pfx/.p12) bundle. The served chain is the
+// leaf followed by the intermediates found in the bundle, in issuing order;
+// the root is left out, as clients have to trust it on their own.
+func parsePKCS12(data []byte, password string) (tls.Certificate, error) {
+	key, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain := []*x509.Certificate{leaf}
+	for cert := leaf; ; {
+		issuer := findIssuer(cert, caCerts)
+		if issuer == nil || bytes.Equal(issuer.RawSubject, issuer.RawIssuer) || len(chain) > len(caCerts) {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+
+	var certPEM []byte
+	for _, cert := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// X509KeyPair checks that the key belongs to the leaf.
+	return tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// findIssuer returns the certificate among candidates that signed cert.
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, c := range candidates {
+		if bytes.Equal(c.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
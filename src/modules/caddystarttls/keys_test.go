@@ -0,0 +1,85 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestCustomTLSEncryptedKey(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCertificate(t, "mail.example.com")
+	certPath, _ := writeTestKeyPair(t, dir, "mail", cert)
+	keyDER, err := pkcs8.MarshalPrivateKey(cert.PrivateKey, []byte("s3cret"), nil)
+	if err != nil {
+		t.Fatalf("encrypting key: %v", err)
+	}
+	keyPath := filepath.Join(dir, "mail.key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEY_PASSWORD", "s3cret")
+
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, KeyPassword: "{env.TEST_KEY_PASSWORD}", ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+	if got := servedCertificate(t, c, "").Leaf.Subject.CommonName; got != "mail.example.com" {
+		t.Errorf("served certificate = %s", got)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, password := range []string{"", "wrong"} {
+		c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, KeyPassword: password, ReloadInterval: -1}
+		if err := c.Provision(ctx); err == nil {
+			t.Errorf("Provision() with key_password %q succeeded, want error", password)
+		}
+	}
+}
+
+func TestCustomTLSPKCS12(t *testing.T) {
+	root, rootKey := newTestCA(t, "Root CA", nil, nil)
+	intermediate, intermediateKey := newTestCA(t, "Issuing CA", root, rootKey)
+	leaf := testCertOptions{names: []string{"relay.example.com"}, issuer: intermediate, issuerKey: intermediateKey}.issue(t)
+	leafCert, err := x509.ParseCertificate(leaf.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows exports list the CA certificates in no particular order.
+	pfx, err := pkcs12.Modern.Encode(leaf.PrivateKey, leafCert, []*x509.Certificate{root, intermediate}, "s3cret")
+	if err != nil {
+		t.Fatalf("encoding PKCS#12: %v", err)
+	}
+	pfxPath := filepath.Join(t.TempDir(), "relay.pfx")
+	if err := os.WriteFile(pfxPath, pfx, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &CustomTLS{PKCS12File: pfxPath, PKCS12Password: "s3cret", ReloadInterval: -1, OCSP: &OCSPStapling{Disabled: true}}
+	provisionCustomTLS(t, c)
+	served := servedCertificate(t, c, "relay.example.com")
+	if len(served.Certificate) != 2 {
+		t.Fatalf("served chain has %d certificates, want leaf and intermediate", len(served.Certificate))
+	}
+	got, err := x509.ParseCertificate(served.Certificate[1])
+	if err != nil {
+		t.Fatalf("parsing served chain: %v", err)
+	}
+	if got.Subject.CommonName != "Issuing CA" {
+		t.Errorf("served chain[1] = %s, want Issuing CA", got.Subject)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	wrong := &CustomTLS{PKCS12File: pfxPath, PKCS12Password: "wrong", ReloadInterval: -1}
+	if err := wrong.Provision(ctx); err == nil {
+		t.Error("Provision() with wrong pkcs12_password succeeded, want error")
+	}
+}
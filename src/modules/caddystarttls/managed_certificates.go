@@ -0,0 +1,115 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/certmagic"
+)
+
+// ManagedCertificates selects certificates from the certificate cache of
+// Caddy's tls app, i.e. certificates obtained by its automation (ACME) or
+// loaded by it. They take precedence over the handler's certificate files,
+// which are served when no managed certificate matches.
+//
+// The tls app has to be told to manage the subjects, e.g. by a site block
+// or an automation policy for them; custom_tls only picks them up.
+type ManagedCertificates struct {
+	// Server names to serve managed certificates for. Wildcards such as
+	// *.example.com are allowed. Default: any name the cache has a
+	// certificate for. The first subject is used for clients without SNI
+	// if no default_sni is set.
+	Subjects []string `json:"subjects,omitempty"`
+
+	// Only serve certificates carrying one of these tags, as set by the
+	// tls app's certificate loaders.
+	Tags []string `json:"tags,omitempty"`
+
+	// matching returns the cached certificates for a name.
+	matching func(name string) []certmagic.Certificate
+}
+
+// provision makes sure the tls app and with it the certificate cache is loaded.
+func (m *ManagedCertificates) provision(ctx caddy.Context) error {
+	if len(m.Subjects) == 0 && len(m.Tags) == 0 {
+		return fmt.Errorf("managed: subjects or tags are required")
+	}
+	if m.matching == nil {
+		if _, err := ctx.App("tls"); err != nil {
+			return fmt.Errorf("managed: loading tls app: %v", err)
+		}
+		m.matching = caddytls.AllMatchingCertificates
+	}
+	return nil
+}
+
+// certificate returns the managed certificate to serve for serverName, or
+// nil if there is none. Of several matching certificates the one valid the
+// longest is chosen.
+func (m *ManagedCertificates) certificate(serverName string) *tls.Certificate {
+	name := strings.ToLower(serverName)
+	if name == "" {
+		if len(m.Subjects) == 0 {
+			return nil
+		}
+		name = m.Subjects[0]
+	}
+	if len(m.Subjects) > 0 && !slices.ContainsFunc(m.Subjects, func(subject string) bool {
+		return certmagic.MatchWildcard(name, subject)
+	}) {
+		return nil
+	}
+
+	var best *certmagic.Certificate
+	for _, cert := range m.matching(name) {
+		if cert.Leaf == nil || cert.Expired() || !m.hasTag(cert) {
+			continue
+		}
+		if best == nil || cert.Leaf.NotAfter.After(best.Leaf.NotAfter) {
+			best = &cert
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return &best.Certificate
+}
+
+// hasTag reports whether cert carries one of the configured tags.
+func (m *ManagedCertificates) hasTag(cert certmagic.Certificate) bool {
+	return len(m.Tags) == 0 || slices.ContainsFunc(m.Tags, cert.HasTag)
+}
+
+// unmarshalCaddyfile parses a managed block:
+//
+//	managed [<subjects>...] {
+//		subjects <subjects>...
+//		tags <tags>...
+//	}
+func (m *ManagedCertificates) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	m.Subjects = append(m.Subjects, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "subjects":
+			subjects := d.RemainingArgs()
+			if len(subjects) == 0 {
+				return d.ArgErr()
+			}
+			m.Subjects = append(m.Subjects, subjects...)
+		case "tags":
+			tags := d.RemainingArgs()
+			if len(tags) == 0 {
+				return d.ArgErr()
+			}
+			m.Tags = append(m.Tags, tags...)
+		default:
+			return d.Errf("unrecognized managed option: %s", d.Val())
+		}
+	}
+	return nil
+}
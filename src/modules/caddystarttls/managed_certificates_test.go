@@ -0,0 +1,154 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+// testCertCache stands in for the tls app's certificate cache.
+func testCertCache(certs ...certmagic.Certificate) func(string) []certmagic.Certificate {
+	return func(name string) []certmagic.Certificate {
+		var matching []certmagic.Certificate
+		for _, cert := range certs {
+			if slices.ContainsFunc(cert.Names, func(certName string) bool { return certmagic.MatchWildcard(name, certName) }) {
+				matching = append(matching, cert)
+			}
+		}
+		return matching
+	}
+}
+
+// newTestManagedCertificate returns a cache entry for a certificate for names
+// that expires after validFor.
+func newTestManagedCertificate(t *testing.T, validFor time.Duration, tags []string, names ...string) certmagic.Certificate {
+	t.Helper()
+	cert := testCertOptions{names: names, notAfter: time.Now().Add(validFor)}.issue(t)
+	return certmagic.Certificate{Certificate: cert, Names: names, Tags: tags}
+}
+
+func TestManagedCertificatesSelect(t *testing.T) {
+	mail := newTestManagedCertificate(t, 24*time.Hour, []string{"smtp"}, "mail.example.com")
+	renewed := newTestManagedCertificate(t, 48*time.Hour, []string{"smtp"}, "mail.example.com")
+	expired := newTestManagedCertificate(t, -time.Hour, []string{"smtp"}, "old.example.com")
+	wildcard := newTestManagedCertificate(t, 24*time.Hour, nil, "*.example.net")
+	cache := testCertCache(mail, renewed, expired, wildcard)
+
+	tests := []struct {
+		name       string
+		managed    ManagedCertificates
+		serverName string
+		want       *certmagic.Certificate
+	}{
+		{name: "longest valid", managed: ManagedCertificates{Subjects: []string{"mail.example.com"}}, serverName: "MAIL.example.com", want: &renewed},
+		{name: "no sni uses first subject", managed: ManagedCertificates{Subjects: []string{"mail.example.com"}}, want: &renewed},
+		{name: "not a subject", managed: ManagedCertificates{Subjects: []string{"relay.example.com"}}, serverName: "mail.example.com"},
+		{name: "wildcard subject", managed: ManagedCertificates{Subjects: []string{"*.example.net"}}, serverName: "mx.example.net", want: &wildcard},
+		{name: "by tag", managed: ManagedCertificates{Tags: []string{"smtp"}}, serverName: "mail.example.com", want: &renewed},
+		{name: "tag missing", managed: ManagedCertificates{Tags: []string{"smtp"}}, serverName: "mx.example.net"},
+		{name: "no sni without subjects", managed: ManagedCertificates{Tags: []string{"smtp"}}},
+		{name: "expired", managed: ManagedCertificates{Tags: []string{"smtp"}}, serverName: "old.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.managed.matching = cache
+			got := tt.managed.certificate(tt.serverName)
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("certificate(%q) = %v, want none", tt.serverName, got.Leaf.DNSNames)
+				}
+				return
+			}
+			if got == nil || got.Leaf != tt.want.Leaf {
+				t.Errorf("certificate(%q) = %v, want the certificate for %v expiring %s", tt.serverName, got, tt.want.Names, tt.want.Leaf.NotAfter)
+			}
+		})
+	}
+}
+
+func TestCustomTLSManagedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "static", newTestCertificate(t, "static.example.com"))
+	managed := newTestManagedCertificate(t, 24*time.Hour, nil, "mail.example.com")
+
+	c := &CustomTLS{
+		CertPath:       certPath,
+		KeyPath:        keyPath,
+		Managed:        &ManagedCertificates{Subjects: []string{"mail.example.com"}, matching: testCertCache(managed)},
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, c)
+
+	if got := servedCertificate(t, c, "mail.example.com"); got.Leaf != managed.Leaf {
+		t.Errorf("served %v for a managed subject, want the managed certificate", got.Leaf.DNSNames)
+	}
+	if got := servedCertificate(t, c, "static.example.com").Leaf.Subject.CommonName; got != "static.example.com" {
+		t.Errorf("fallback certificate = %s", got)
+	}
+
+	// Without files, names the cache has nothing for fail the handshake.
+	managedOnly := &CustomTLS{
+		Managed:        &ManagedCertificates{Subjects: []string{"mail.example.com"}, matching: testCertCache(managed)},
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, managedOnly)
+	if _, err := managedOnly.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("GetCertificate() for an unmanaged name succeeded")
+	}
+}
+
+func TestManagedCertificatesUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    ManagedCertificates
+		wantErr bool
+	}{
+		{
+			name:  "subjects as arguments",
+			input: `managed mail.example.com *.example.net`,
+			want:  ManagedCertificates{Subjects: []string{"mail.example.com", "*.example.net"}},
+		},
+		{
+			name: "block",
+			input: `managed {
+				subjects mail.example.com
+				tags smtp relay
+			}`,
+			want: ManagedCertificates{Subjects: []string{"mail.example.com"}, Tags: []string{"smtp", "relay"}},
+		},
+		{
+			name: "tags without values",
+			input: `managed {
+				tags
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown option",
+			input: `managed {
+				issuer acme
+			}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			d.Next()
+			var m ManagedCertificates
+			err := m.unmarshalCaddyfile(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(m, tt.want) {
+				t.Errorf("unmarshalCaddyfile() = %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
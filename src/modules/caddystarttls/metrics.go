@@ -0,0 +1,65 @@
+package caddystarttls
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace, metricsSubsystem = "caddy", "starttls"
+
+// The collectors are shared by all handler instances and survive config
+// reloads, so counters keep counting across "Save & Reload".
+var (
+	upstreamTLSHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "upstream_tls_handshakes_total",
+		Help:      "TLS handshakes with STARTTLS upstreams, by whether the session was resumed.",
+	}, []string{"upstream", "resumed"})
+
+	certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of custom_tls file certificates as Unix time, by certificate file.",
+	}, []string{"cert_path"})
+
+	tlsHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tls_handshake_failures_total",
+		Help:      "Failed custom_tls handshakes, by reason.",
+	}, []string{"reason"})
+
+	tlsHandshakesQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tls_handshakes_queued",
+		Help:      "custom_tls handshakes waiting for one of the max_concurrent_handshakes slots.",
+	})
+
+	tlsHandshakesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tls_handshakes_rejected_total",
+		Help:      "custom_tls connections closed because no handshake slot became free in time.",
+	})
+)
+
+// registerMetrics registers the given collectors with the metrics registry
+// of the current config. Several handler instances register the same
+// collectors, so duplicate registrations are ignored.
+func registerMetrics(ctx caddy.Context, collectors ...prometheus.Collector) {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return
+	}
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil && !errors.As(err, new(prometheus.AlreadyRegisteredError)) {
+			ctx.Logger().Warn("registering metrics failed", zap.Error(err))
+		}
+	}
+}
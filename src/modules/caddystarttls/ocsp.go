@@ -0,0 +1,236 @@
+package caddystarttls
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspFetchTimeout bounds a single request to an OCSP responder.
+	ocspFetchTimeout = 10 * time.Second
+	// ocspCheckInterval is how often staples are checked for renewal.
+	ocspCheckInterval = time.Hour
+	// ocspMaxResponseSize limits how much of a responder's answer is read.
+	ocspMaxResponseSize = 1 << 20
+)
+
+// OCSPStapling configures OCSP stapling for custom_tls certificates.
+// Stapling is enabled by default for certificates that name an OCSP
+// responder and include their issuer in the chain.
+type OCSPStapling struct {
+	// Disables OCSP stapling.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Directory OCSP responses are cached in, so that they survive restarts.
+	// Default: custom_tls/ocsp in Caddy's data directory.
+	CacheDir string `json:"cache_dir,omitempty"`
+
+	// Stop serving certificates whose OCSP status is revoked.
+	RefuseRevoked bool `json:"refuse_revoked,omitempty"`
+}
+
+// unmarshalCaddyfile parses `ocsp off` or an ocsp block.
+func (o *OCSPStapling) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		if d.Val() != "off" {
+			return d.ArgErr()
+		}
+		o.Disabled = true
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "cache_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			o.CacheDir = d.Val()
+		case "refuse_revoked":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			o.RefuseRevoked = true
+		default:
+			return d.Errf("unrecognized ocsp option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// ocspStapler keeps the OCSP staples of certificates current.
+type ocspStapler struct {
+	cacheDir      string
+	refuseRevoked bool
+	client        *http.Client
+	logger        *zap.Logger
+}
+
+func newOCSPStapler(cfg *OCSPStapling, logger *zap.Logger) *ocspStapler {
+	s := &ocspStapler{
+		cacheDir: filepath.Join(caddy.AppDataDir(), "custom_tls", "ocsp"),
+		client:   &http.Client{Timeout: ocspFetchTimeout},
+		logger:   logger,
+	}
+	if cfg != nil {
+		if cfg.CacheDir != "" {
+			s.cacheDir = cfg.CacheDir
+		}
+		s.refuseRevoked = cfg.RefuseRevoked
+	}
+	return s
+}
+
+// staple makes f serve a current OCSP response, from the cache or, if fetch
+// is set, fetched from the responder once the cached one is halfway to its
+// NextUpdate. It reports whether f was refused or allowed again, in which
+// case the certificate index has to be rebuilt.
+func (s *ocspStapler) staple(ctx context.Context, f *certFile, fetch bool) (bool, error) {
+	cert := f.cert.Load()
+	if cert == nil || cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 {
+		return false, nil
+	}
+	leaf := cert.Leaf
+	if len(cert.Certificate) < 2 {
+		return false, fmt.Errorf("stapling OCSP for %s: issuer certificate missing from chain", f.certPath)
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return false, fmt.Errorf("stapling OCSP for %s: parsing issuer: %v", f.certPath, err)
+	}
+
+	resp := f.ocspResp
+	if resp == nil || resp.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		resp = s.loadCached(leaf, issuer)
+	}
+	var fetchErr error
+	if fetch && (resp == nil || ocspNeedsRefresh(resp, time.Now())) {
+		fresh, err := s.fetch(ctx, leaf, issuer)
+		if err != nil {
+			fetchErr = fmt.Errorf("stapling OCSP for %s: %w", f.certPath, err)
+		} else {
+			resp = fresh
+			if err := s.storeCached(leaf, fresh.Raw); err != nil {
+				s.logger.Warn("caching OCSP response failed", zap.String("cert_path", f.certPath), zap.Error(err))
+			}
+		}
+	}
+	if resp != nil && !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		// An expired staple is worse than none.
+		resp = nil
+	}
+
+	var staple []byte
+	refused := false
+	if resp != nil {
+		switch resp.Status {
+		case ocsp.Good:
+			staple = resp.Raw
+		case ocsp.Revoked:
+			staple = resp.Raw
+			refused = s.refuseRevoked
+			if resp != f.ocspResp {
+				s.logger.Error("certificate has been revoked",
+					zap.String("cert_path", f.certPath),
+					zap.Time("revoked_at", resp.RevokedAt),
+					zap.Bool("refused", refused))
+			}
+		}
+	}
+	f.ocspResp = resp
+
+	if !bytes.Equal(cert.OCSPStaple, staple) {
+		stapled := *cert
+		stapled.OCSPStaple = staple
+		f.cert.Store(&stapled)
+	}
+	changed := f.refused != refused
+	f.refused = refused
+	return changed, fetchErr
+}
+
+// ocspNeedsRefresh reports whether resp is old enough to be replaced:
+// halfway through its validity, or after ocspCheckInterval if the responder
+// did not say when the next update is due.
+func ocspNeedsRefresh(resp *ocsp.Response, now time.Time) bool {
+	if resp.NextUpdate.IsZero() {
+		return now.Sub(resp.ThisUpdate) > ocspCheckInterval
+	}
+	refreshAt := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	return now.After(refreshAt)
+}
+
+// fetch asks the certificate's responder for its current status.
+func (s *ocspStapler) fetch(ctx context.Context, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	reqDER, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %s returned %s", leaf.OCSPServer[0], httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	resp, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+	return resp, nil
+}
+
+// cachePath returns the file the OCSP response for leaf is cached in.
+func (s *ocspStapler) cachePath(leaf *x509.Certificate) string {
+	sum := sha256.Sum256(leaf.Raw)
+	return filepath.Join(s.cacheDir, hex.EncodeToString(sum[:])+".ocsp")
+}
+
+// loadCached returns the cached response for leaf if it is still valid.
+func (s *ocspStapler) loadCached(leaf, issuer *x509.Certificate) *ocsp.Response {
+	der, err := os.ReadFile(s.cachePath(leaf))
+	if err != nil {
+		return nil
+	}
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil || (!resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate)) {
+		return nil
+	}
+	return resp
+}
+
+func (s *ocspStapler) storeCached(leaf *x509.Certificate, der []byte) error {
+	if err := os.MkdirAll(s.cacheDir, 0o700); err != nil {
+		return err
+	}
+	path := s.cachePath(leaf)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, der, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
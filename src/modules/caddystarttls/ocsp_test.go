@@ -0,0 +1,200 @@
+package caddystarttls
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testOCSPResponder answers OCSP requests for certificates issued by ca
+// with the configured status and counts the requests.
+type testOCSPResponder struct {
+	*httptest.Server
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func startTestOCSPResponder(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *testOCSPResponder {
+	t.Helper()
+	r := new(testOCSPResponder)
+	r.status.Store(int32(ocsp.Good))
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Add(1)
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ocspReq, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := ocsp.Response{
+			Status:       int(r.status.Load()),
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if tmpl.Status == ocsp.Revoked {
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, tmpl, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// waitForOCSP waits until the handler's background OCSP update made done
+// report true.
+func waitForOCSP(t *testing.T, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatal("OCSP response not fetched in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCustomTLSOCSPStapling(t *testing.T) {
+	ca, caKey := newTestCA(t, "Mail CA", nil, nil)
+	responder := startTestOCSPResponder(t, ca, caKey)
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", testCertOptions{names: []string{"mail.example.com"}, issuer: ca, issuerKey: caKey, ocspURL: responder.URL}.issue(t))
+
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, OCSP: &OCSPStapling{CacheDir: cacheDir}}
+	provisionCustomTLS(t, c)
+	waitForOCSP(t, func() bool { return len(servedCertificate(t, c, "").OCSPStaple) > 0 })
+
+	state, _, err := handshakeCustomTLS(t, c, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if len(state.OCSPResponse) == 0 {
+		t.Fatal("no OCSP response stapled")
+	}
+	resp, err := ocsp.ParseResponse(state.OCSPResponse, ca)
+	if err != nil {
+		t.Fatalf("parsing stapled response: %v", err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("stapled status = %d, want good", resp.Status)
+	}
+
+	// A second handler uses the cached response without asking the responder.
+	responder.Close()
+	requests := responder.requests.Load()
+	cached := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, OCSP: &OCSPStapling{CacheDir: cacheDir}}
+	provisionCustomTLS(t, cached)
+	if len(servedCertificate(t, cached, "").OCSPStaple) == 0 {
+		t.Error("cached OCSP response not stapled")
+	}
+	if got := responder.requests.Load(); got != requests {
+		t.Errorf("responder asked again despite a fresh cached response")
+	}
+}
+
+func TestCustomTLSOCSPRevoked(t *testing.T) {
+	ca, caKey := newTestCA(t, "Mail CA", nil, nil)
+	responder := startTestOCSPResponder(t, ca, caKey)
+	responder.status.Store(int32(ocsp.Revoked))
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", testCertOptions{names: []string{"mail.example.com"}, issuer: ca, issuerKey: caKey, ocspURL: responder.URL}.issue(t))
+
+	for _, refuse := range []bool{false, true} {
+		c := &CustomTLS{
+			CertPath:       certPath,
+			KeyPath:        keyPath,
+			ReloadInterval: -1,
+			OCSP:           &OCSPStapling{CacheDir: t.TempDir(), RefuseRevoked: refuse},
+		}
+		provisionCustomTLS(t, c)
+
+		waitForOCSP(t, func() bool {
+			cert, err := c.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "mail.example.com"})
+			if refuse {
+				// Refused once the revocation is known.
+				return err != nil
+			}
+			if err != nil {
+				t.Fatalf("GetCertificate: %v", err)
+			}
+			return len(cert.OCSPStaple) > 0
+		})
+	}
+}
+
+func TestCustomTLSOCSPUnavailable(t *testing.T) {
+	ca, caKey := newTestCA(t, "Mail CA", nil, nil)
+	responder := startTestOCSPResponder(t, ca, caKey)
+	responder.Close()
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", testCertOptions{names: []string{"mail.example.com"}, issuer: ca, issuerKey: caKey, ocspURL: responder.URL}.issue(t))
+
+	// An unreachable responder must not keep the certificate from being served.
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, OCSP: &OCSPStapling{CacheDir: t.TempDir()}}
+	provisionCustomTLS(t, c)
+	if cert := servedCertificate(t, c, ""); len(cert.OCSPStaple) != 0 {
+		t.Error("unexpected OCSP staple")
+	}
+	if entries, _ := os.ReadDir(c.stapler.cacheDir); len(entries) != 0 {
+		t.Errorf("cache written without a response: %v", entries)
+	}
+}
+
+func TestCustomTLSOCSPDoesNotDelayProvision(t *testing.T) {
+	ca, caKey := newTestCA(t, "Mail CA", nil, nil)
+	hang := make(chan struct{})
+	responder := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-hang }))
+	t.Cleanup(responder.Close)
+	t.Cleanup(func() { close(hang) })
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", testCertOptions{names: []string{"mail.example.com"}, issuer: ca, issuerKey: caKey, ocspURL: responder.URL}.issue(t))
+
+	// A responder that never answers must not hold up the config load.
+	start := time.Now()
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, OCSP: &OCSPStapling{CacheDir: t.TempDir()}}
+	provisionCustomTLS(t, c)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Provision took %s waiting for the OCSP responder", elapsed)
+	}
+	if cert := servedCertificate(t, c, ""); len(cert.OCSPStaple) != 0 {
+		t.Error("unexpected OCSP staple")
+	}
+}
+
+func TestOCSPNeedsRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		resp ocsp.Response
+		want bool
+	}{
+		{"fresh", ocsp.Response{ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(23 * time.Hour)}, false},
+		{"past halfway", ocsp.Response{ThisUpdate: now.Add(-13 * time.Hour), NextUpdate: now.Add(11 * time.Hour)}, true},
+		{"no next update, recent", ocsp.Response{ThisUpdate: now.Add(-time.Minute)}, false},
+		{"no next update, old", ocsp.Response{ThisUpdate: now.Add(-2 * ocspCheckInterval)}, true},
+	}
+	for _, tt := range tests {
+		if got := ocspNeedsRefresh(&tt.resp, now); got != tt.want {
+			t.Errorf("%s: ocspNeedsRefresh() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	// defaultTicketRotationInterval is how often a new session ticket key is
+	// generated.
+	defaultTicketRotationInterval = 12 * time.Hour
+	// defaultTicketMaxKeys is how many keys are kept, the newest for issuing
+	// tickets and the others to accept tickets issued before a rotation.
+	defaultTicketMaxKeys = 4
+	// ticketKeyCheckInterval is how often keys are checked for rotation and
+	// for changes made by other nodes or to the key file.
+	ticketKeyCheckInterval = time.Minute
+	// ticketKeysStorageKey is where shared keys are kept in Caddy's storage.
+	ticketKeysStorageKey = "custom_tls/session_ticket_keys.json"
+)
+
+// SessionTickets configures the keys TLS session tickets are encrypted
+// with. By default, each process generates its own keys, so resumption does
+// not work across nodes or config reloads. With storage, nodes sharing
+// Caddy's storage share the keys, and one of them rotates them.
+type SessionTickets struct {
+	// Disables session tickets, so sessions cannot be resumed with them.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// File with one base64-encoded 32-byte key per line, newest first, e.g.
+	// generated with `openssl rand -base64 32`. The first key encrypts new
+	// tickets. The file is rotated externally and re-read when it changes.
+	KeyFile string `json:"key_file,omitempty"`
+
+	// Keep the keys in Caddy's storage, shared by all nodes using it.
+	Storage bool `json:"storage,omitempty"`
+
+	// How often a new key is generated, unless a key_file is used.
+	// Default: 12h.
+	RotationInterval caddy.Duration `json:"rotation_interval,omitempty"`
+
+	// Number of keys to keep, including the current one. Default: 4.
+	MaxKeys int `json:"max_keys,omitempty"`
+
+	storage certmagic.Storage
+
+	// Only touched by the initial update and the maintenance goroutine.
+	keys        [][32]byte
+	created     time.Time
+	fileModTime time.Time
+}
+
+// provision validates the options and applies their defaults.
+func (s *SessionTickets) provision(ctx caddy.Context) error {
+	if s.Disabled {
+		return nil
+	}
+	if s.KeyFile != "" && s.Storage {
+		return fmt.Errorf("session_tickets: key_file and storage are mutually exclusive")
+	}
+	if s.RotationInterval <= 0 {
+		s.RotationInterval = caddy.Duration(defaultTicketRotationInterval)
+	}
+	if s.MaxKeys <= 0 {
+		s.MaxKeys = defaultTicketMaxKeys
+	}
+	if s.Storage && s.storage == nil {
+		s.storage = ctx.Storage()
+	}
+	return nil
+}
+
+// configure disables session tickets on cfg or sets its initial keys.
+func (s *SessionTickets) configure(ctx context.Context, cfg *tls.Config) error {
+	if s.Disabled {
+		cfg.SessionTicketsDisabled = true
+		return nil
+	}
+	return s.update(ctx, cfg)
+}
+
+// update rotates the keys if they are due and sets them on cfg if they changed.
+func (s *SessionTickets) update(ctx context.Context, cfg *tls.Config) error {
+	var changed bool
+	var err error
+	switch {
+	case s.KeyFile != "":
+		changed, err = s.loadFile()
+	case s.storage != nil:
+		changed, err = s.syncStorage(ctx)
+	default:
+		changed, err = s.rotate(time.Now()), nil
+	}
+	if err != nil {
+		return err
+	}
+	if changed {
+		cfg.SetSessionTicketKeys(s.keys)
+	}
+	return nil
+}
+
+// rotate generates a new key if the newest one is older than the rotation
+// interval, and reports whether it did.
+func (s *SessionTickets) rotate(now time.Time) bool {
+	if len(s.keys) > 0 && now.Sub(s.created) < time.Duration(s.RotationInterval) {
+		return false
+	}
+	var key [32]byte
+	rand.Read(key[:])
+	s.keys = append([][32]byte{key}, s.keys...)
+	if len(s.keys) > s.MaxKeys {
+		s.keys = s.keys[:s.MaxKeys]
+	}
+	s.created = now
+	return true
+}
+
+// loadFile reads the key file if it changed since the last call.
+func (s *SessionTickets) loadFile() (bool, error) {
+	info, err := os.Stat(s.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("session_tickets: %v", err)
+	}
+	if len(s.keys) > 0 && info.ModTime().Equal(s.fileModTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("session_tickets: %v", err)
+	}
+	keys, err := parseTicketKeys(data)
+	if err != nil {
+		return false, fmt.Errorf("session_tickets: %s: %v", s.KeyFile, err)
+	}
+	s.keys, s.fileModTime = keys, info.ModTime()
+	return true, nil
+}
+
+// parseTicketKeys parses base64-encoded 32-byte keys, one per line. Empty
+// lines and lines starting with # are ignored.
+func parseTicketKeys(data []byte) ([][32]byte, error) {
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("line %d: not a base64-encoded 32-byte key", line)
+		}
+		keys = append(keys, [32]byte(raw))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, scanner.Err()
+}
+
+// syncStorage loads the shared keys and rotates them if they are due.
+func (s *SessionTickets) syncStorage(ctx context.Context) (bool, error) {
+	stored, err := keyRotation[[]byte]{
+		storage:  s.storage,
+		key:      ticketKeysStorageKey,
+		interval: time.Duration(s.RotationInterval),
+		maxKeys:  s.MaxKeys,
+		generate: func([][]byte) ([]byte, error) {
+			key := make([]byte, 32)
+			rand.Read(key)
+			return key, nil
+		},
+	}.sync(ctx)
+	if err != nil {
+		return false, fmt.Errorf("session_tickets: %v", err)
+	}
+
+	if stored.Created.Equal(s.created) && len(stored.Keys) == len(s.keys) {
+		return false, nil
+	}
+	keys := make([][32]byte, 0, len(stored.Keys))
+	for _, key := range stored.Keys {
+		if len(key) != 32 {
+			return false, fmt.Errorf("session_tickets: invalid key in storage")
+		}
+		keys = append(keys, [32]byte(key))
+	}
+	s.keys, s.created = keys, stored.Created
+	return true, nil
+}
+
+// unmarshalCaddyfile parses `session_tickets off` or a session_tickets block:
+//
+//	session_tickets {
+//		key_file <path>
+//		storage
+//		rotation_interval <duration>
+//		max_keys <n>
+//	}
+func (s *SessionTickets) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		if d.Val() != "off" {
+			return d.ArgErr()
+		}
+		s.Disabled = true
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.KeyFile = d.Val()
+		case "storage":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Storage = true
+		case "rotation_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid rotation_interval: %v", err)
+			}
+			s.RotationInterval = caddy.Duration(dur)
+		case "max_keys":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxKeys, err := strconv.Atoi(d.Val())
+			if err != nil || maxKeys < 1 {
+				return d.Errf("invalid max_keys: %s", d.Val())
+			}
+			s.MaxKeys = maxKeys
+		default:
+			return d.Errf("unrecognized session_tickets option: %s", d.Val())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package caddystarttls
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+// resumesAcross reports whether a session established with first is
+// resumed by second, as when a client reconnects to another node.
+func resumesAcross(t *testing.T, first, second *CustomTLS) bool {
+	t.Helper()
+	clientCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "mail.example.com",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	if _, _, err := handshakeCustomTLS(t, first, clientCfg); err != nil {
+		t.Fatalf("first handshake: %v", err)
+	}
+	state, _, err := handshakeCustomTLS(t, second, clientCfg)
+	if err != nil {
+		t.Fatalf("second handshake: %v", err)
+	}
+	return state.DidResume
+}
+
+func TestCustomTLSSessionTickets(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	keyFile := filepath.Join(dir, "tickets.keys")
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := os.WriteFile(keyFile, []byte("# current key first\n"+key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	tests := []struct {
+		name       string
+		tickets    func() *SessionTickets
+		wantResume bool
+	}{
+		{"per-process keys", func() *SessionTickets { return nil }, false},
+		{"in-memory keys", func() *SessionTickets { return &SessionTickets{} }, false},
+		{"key file", func() *SessionTickets { return &SessionTickets{KeyFile: keyFile} }, true},
+		{"shared storage", func() *SessionTickets { return &SessionTickets{Storage: true, storage: storage} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := make([]*CustomTLS, 2)
+			for i := range nodes {
+				nodes[i] = &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, SessionTickets: tt.tickets()}
+				provisionCustomTLS(t, nodes[i])
+			}
+			if !resumesAcross(t, nodes[0], nodes[0]) {
+				t.Error("session not resumed on the same node")
+			}
+			if got := resumesAcross(t, nodes[0], nodes[1]); got != tt.wantResume {
+				t.Errorf("resumed on another node = %v, want %v", got, tt.wantResume)
+			}
+		})
+	}
+}
+
+func TestCustomTLSSessionTicketsDisabled(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1, SessionTickets: &SessionTickets{Disabled: true}}
+	provisionCustomTLS(t, c)
+	if resumesAcross(t, c, c) {
+		t.Error("session resumed with session tickets disabled")
+	}
+}
+
+func TestSessionTicketsStorageRotation(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	nodes := make([]*SessionTickets, 2)
+	for i := range nodes {
+		nodes[i] = &SessionTickets{Storage: true, MaxKeys: 2, storage: storage}
+		if err := nodes[i].provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := nodes[i].configure(ctx, new(tls.Config)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nodes[0].keys[0] != nodes[1].keys[0] {
+		t.Fatal("nodes sharing storage use different keys")
+	}
+
+	// Once the keys are due, the first node to notice rotates them and the
+	// other picks up the rotated keys.
+	for i := range nodes {
+		nodes[i].RotationInterval = caddy.Duration(time.Nanosecond)
+	}
+	old := nodes[0].keys[0]
+	if err := nodes[0].update(ctx, new(tls.Config)); err != nil {
+		t.Fatal(err)
+	}
+	nodes[1].RotationInterval = caddy.Duration(time.Hour)
+	if err := nodes[1].update(ctx, new(tls.Config)); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range nodes {
+		if len(n.keys) != 2 || n.keys[0] == old || n.keys[1] != old {
+			t.Errorf("node %d did not rotate keys", i)
+		}
+	}
+
+	// Only max_keys keys are kept.
+	if err := nodes[0].update(ctx, new(tls.Config)); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes[0].keys) != 2 || nodes[0].keys[1] == old {
+		t.Errorf("kept %d keys including the oldest, want 2", len(nodes[0].keys))
+	}
+}
+
+func TestParseTicketKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name     string
+		data     string
+		wantKeys int
+		wantErr  string
+	}{
+		{"keys and comments", "# rotated daily\n" + key + "\n\n" + key + "\n", 2, ""},
+		{"short key", base64.StdEncoding.EncodeToString(make([]byte, 16)), 0, "line 1"},
+		{"not base64", "# header\nnot a key", 0, "line 2"},
+		{"empty", "# nothing yet\n", 0, "no keys found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseTicketKeys([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseTicketKeys() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(keys) != tt.wantKeys {
+				t.Errorf("parseTicketKeys() = %d keys, %v, want %d keys", len(keys), err, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestSessionTicketsProvisionErrors(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s := &SessionTickets{KeyFile: "/etc/tickets.keys", Storage: true}
+	if err := s.provision(ctx); err == nil {
+		t.Error("provision() succeeded with both key_file and storage")
+	}
+}
+
+func TestSessionTicketsUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    SessionTickets
+		wantErr bool
+	}{
+		{
+			name:  "off",
+			input: `session_tickets off`,
+			want:  SessionTickets{Disabled: true},
+		},
+		{
+			name: "storage",
+			input: `session_tickets {
+				storage
+				rotation_interval 6h
+				max_keys 3
+			}`,
+			want: SessionTickets{Storage: true, RotationInterval: caddy.Duration(6 * time.Hour), MaxKeys: 3},
+		},
+		{
+			name: "key file",
+			input: `session_tickets {
+				key_file /etc/caddy/tickets.keys
+			}`,
+			want: SessionTickets{KeyFile: "/etc/caddy/tickets.keys"},
+		},
+		{name: "unknown argument", input: `session_tickets on`, wantErr: true},
+		{
+			name: "invalid max_keys",
+			input: `session_tickets {
+				max_keys 0
+			}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+			d.Next()
+			var s SessionTickets
+			err := s.unmarshalCaddyfile(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("unmarshalCaddyfile() = %+v, want %+v", s, tt.want)
+			}
+		})
+	}
+}
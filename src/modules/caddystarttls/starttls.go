@@ -3,13 +3,17 @@ package caddystarttls
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -20,7 +24,41 @@ func init() {
 // StartTLS is a layer4 handler that simulates the SMTP plaintext phase
 // up to the STARTTLS command, then hands over the connection to the next handler
 // (which should be the TLS handler).
-type StartTLS struct{}
+type StartTLS struct {
+	// Optional upstream addresses to probe before acknowledging STARTTLS.
+	// If none of them accepts a TCP connection, the client gets
+	// "454 TLS not available" instead of a session that would fail after the handshake.
+	// The handler cannot see the upstreams of the handlers that follow it, so
+	// these are usually the same addresses as the route's upstream_starttls or
+	// proxy upstreams. The upstreams are probed in parallel, and the result is
+	// reused for a few seconds so that a burst of sessions does not open a
+	// probe connection each.
+	CheckUpstreams []string `json:"check_upstreams,omitempty"`
+
+	// Timeout for the upstream probes. Default 3s.
+	CheckTimeout caddy.Duration `json:"check_timeout,omitempty"`
+
+	// Source address and egress proxy for the probes, as on upstream_starttls.
+	// Set them like there, so that the probes take the same path as the
+	// sessions.
+	LocalAddress string `json:"local_address,omitempty"`
+	Proxy        string `json:"proxy,omitempty"`
+
+	logger  *zap.Logger
+	dialer  egressDialer
+	clients connTracker // Clients still in the plaintext phase
+
+	checkMu     sync.Mutex
+	checkedAt   time.Time // When checkResult was probed, zero if never
+	checkResult bool
+}
+
+const (
+	// defaultCheckTimeout bounds the upstream probes.
+	defaultCheckTimeout = 3 * time.Second
+	// checkCacheTTL is how long a probe result is reused.
+	checkCacheTTL = 5 * time.Second
+)
 
 // CaddyModule returns the Caddy module information.
 func (*StartTLS) CaddyModule() caddy.ModuleInfo {
@@ -30,7 +68,32 @@ func (*StartTLS) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+func (h *StartTLS) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+	if h.CheckTimeout <= 0 {
+		h.CheckTimeout = caddy.Duration(defaultCheckTimeout)
+	}
+	dialer, err := newEgressDialer(h.LocalAddress, h.Proxy, 0, nil)
+	if err != nil {
+		return err
+	}
+	h.dialer = dialer
+	return nil
+}
+
 func (h *StartTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	if !h.clients.add(cx) {
+		// The handler is being cleaned up, e.g. by a config reload.
+		writeShuttingDown(cx)
+		return nil
+	}
+	tracked := true
+	defer func() {
+		if tracked {
+			h.clients.remove(cx)
+		}
+	}()
+
 	// Send initial 220 greeting
 	_, err := cx.Write([]byte("220 StartTLS ready\r\n"))
 	if err != nil {
@@ -41,6 +104,10 @@ func (h *StartTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
+			if h.clients.isDraining() {
+				// Cleanup already told the client and closed the connection.
+				return nil
+			}
 			return err
 		}
 		line = strings.TrimSpace(line)
@@ -53,6 +120,11 @@ func (h *StartTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
 			cx.Write([]byte("250-StartTLS ready\r\n"))
 			cx.Write([]byte("250 STARTTLS\r\n"))
 		case "STARTTLS":
+			if !h.upstreamAvailable(cx.Context) {
+				h.logger.Warn("no upstream reachable, refusing STARTTLS", zap.Strings("upstreams", h.CheckUpstreams))
+				cx.Write([]byte("454 4.7.0 TLS not available due to temporary reason\r\n"))
+				continue
+			}
 			cx.Write([]byte("220 Ready to start TLS\r\n"))
 			// We have likely buffered bytes intended for the TLS handler (e.g. ClientHello).
 			// We must pass them along by wrapping the connection's reader.
@@ -66,6 +138,10 @@ func (h *StartTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
 			newCx := layer4.WrapConnection(bc, nil, cx.Logger)
 			newCx.Context = cx.Context
 
+			// From here on the session belongs to the next handlers.
+			h.clients.remove(cx)
+			tracked = false
+
 			// Hand over to the next handler (the TLS handler)
 			return next.Handle(newCx)
 		case "QUIT":
@@ -78,8 +154,106 @@ func (h *StartTLS) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	}
 }
 
+// Cleanup sends a 421 reply to clients that have not started TLS yet and
+// closes their connections, so that they retry against the new config.
+func (h *StartTLS) Cleanup() error {
+	conns, _ := h.clients.drain()
+	for _, conn := range conns {
+		writeShuttingDown(conn)
+		conn.Close()
+	}
+	if len(conns) > 0 && h.logger != nil {
+		h.logger.Info("closed idle pre-TLS sessions", zap.Int("sessions", len(conns)))
+	}
+	return nil
+}
+
+// upstreamAvailable reports whether any of the configured upstreams accepts
+// a connection through the egress dialer. It is always true if no upstreams
+// are configured.
+func (h *StartTLS) upstreamAvailable(ctx context.Context) bool {
+	if len(h.CheckUpstreams) == 0 {
+		return true
+	}
+	// Sessions arriving while a probe runs wait for its result.
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < checkCacheTTL {
+		return h.checkResult
+	}
+
+	available := h.probeUpstreams(ctx)
+	if ctx.Err() == nil {
+		// Not cached if the probe was cut short by the client going away.
+		h.checkedAt, h.checkResult = time.Now(), available
+	}
+	return available
+}
+
+// probeUpstreams dials all upstreams at once and reports whether any of them
+// accepted the connection within the check timeout.
+func (h *StartTLS) probeUpstreams(ctx context.Context) bool {
+	timeout := time.Duration(h.CheckTimeout)
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make(chan bool, len(h.CheckUpstreams))
+	for _, addr := range h.CheckUpstreams {
+		go func(addr string) {
+			network, address := parseNetworkAddress(addr)
+			conn, err := h.dialer.dial(ctx, network, address)
+			if err == nil {
+				conn.Close()
+			}
+			results <- err == nil
+		}(addr)
+	}
+	for range h.CheckUpstreams {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
 func (h *StartTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "check_upstream":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				h.CheckUpstreams = append(h.CheckUpstreams, args...)
+			case "check_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid check_timeout: %v", err)
+				}
+				h.CheckTimeout = caddy.Duration(dur)
+			case "local_address":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.LocalAddress = d.Val()
+			case "proxy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Proxy = d.Val()
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
 	return nil
 }
 
@@ -153,6 +327,8 @@ func (b *bufferedConn) Read(p []byte) (n int, err error) {
 var (
 	_ layer4.NextHandler    = (*StartTLS)(nil)
 	_ caddyfile.Unmarshaler = (*StartTLS)(nil)
+	_ caddy.Provisioner     = (*StartTLS)(nil)
+	_ caddy.CleanerUpper    = (*StartTLS)(nil)
 	_ layer4.NextHandler    = (*Drop220)(nil)
 	_ caddyfile.Unmarshaler = (*Drop220)(nil)
 )
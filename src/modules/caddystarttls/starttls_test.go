@@ -1,12 +1,18 @@
 package caddystarttls
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"net"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
 )
 
 // mockConn implements net.Conn to help with testing
@@ -119,6 +125,171 @@ func TestStartTLS(t *testing.T) {
 	}
 }
 
+func TestStartTLSCheckUpstreams(t *testing.T) {
+	// Reserve a port and close it again so that nothing is listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := "tcp/" + ln.Addr().String()
+	ln.Close()
+
+	mConn := &mockConn{
+		readBuf:  bytes.NewBufferString("EHLO mail.example.com\r\nSTARTTLS\r\nQUIT\r\n"),
+		writeBuf: new(bytes.Buffer),
+	}
+	l4Conn := layer4.WrapConnection(mConn, nil, nil)
+
+	handler := &StartTLS{
+		CheckUpstreams: []string{deadAddr},
+		CheckTimeout:   caddy.Duration(time.Second),
+		logger:         zap.NewNop(),
+	}
+	next := &mockNextHandler{}
+
+	if err := handler.Handle(l4Conn, next); err != nil {
+		t.Fatalf("Handle returned unexpected error: %v", err)
+	}
+	if next.called {
+		t.Errorf("expected next handler not to be called without a reachable upstream")
+	}
+
+	expectedOut := "220 StartTLS ready\r\n250-StartTLS ready\r\n250 STARTTLS\r\n454 4.7.0 TLS not available due to temporary reason\r\n221 Bye\r\n"
+	if mConn.writeBuf.String() != expectedOut {
+		t.Errorf("expected output %q, got %q", expectedOut, mConn.writeBuf.String())
+	}
+}
+
+func TestStartTLSCheckUpstreamsReachable(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := "tcp/" + dead.Addr().String()
+	dead.Close()
+
+	// A reachable upstream that counts the probes it receives.
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer live.Close()
+	probes := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := live.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			probes <- struct{}{}
+		}
+	}()
+
+	// A proxy that tunnels to anything, for upstreams only reachable through it.
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer proxyLn.Close()
+	connects := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := proxyLn.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				connects <- req.Host
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		handler  *StartTLS
+		sessions int
+		probes   chan struct{}
+		connects chan string
+	}{
+		{name: "one of several reachable", handler: &StartTLS{CheckUpstreams: []string{deadAddr, "tcp/" + live.Addr().String()}}, sessions: 3, probes: probes},
+		{name: "through the egress proxy", handler: &StartTLS{CheckUpstreams: []string{deadAddr}, Proxy: "http://" + proxyLn.Addr().String()}, sessions: 1, connects: connects},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := tt.handler.Provision(ctx); err != nil {
+				t.Fatalf("Provision returned unexpected error: %v", err)
+			}
+			for i := 0; i < tt.sessions; i++ {
+				mConn := &mockConn{readBuf: bytes.NewBufferString("STARTTLS\r\n"), writeBuf: new(bytes.Buffer)}
+				next := &mockNextHandler{}
+				if err := tt.handler.Handle(layer4.WrapConnection(mConn, nil, nil), next); err != nil {
+					t.Fatalf("Handle returned unexpected error: %v", err)
+				}
+				if !next.called {
+					t.Fatalf("expected STARTTLS to be accepted, got %q", mConn.writeBuf.String())
+				}
+			}
+			if tt.probes != nil {
+				<-tt.probes
+				// Later sessions reuse the result instead of probing again.
+				select {
+				case <-tt.probes:
+					t.Error("expected the probe result to be reused")
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			if tt.connects != nil {
+				if host := <-tt.connects; host != strings.TrimPrefix(deadAddr, "tcp/") {
+					t.Errorf("expected the probe to CONNECT to %s, got %s", deadAddr, host)
+				}
+			}
+		})
+	}
+}
+
+func TestStartTLSCleanup(t *testing.T) {
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	handler := &StartTLS{logger: zap.NewNop()}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- handler.Handle(layer4.WrapConnection(proxyEnd, nil, nil), &mockNextHandler{})
+	}()
+
+	client := bufio.NewReader(clientEnd)
+	if greeting, _ := client.ReadString('\n'); greeting != "220 StartTLS ready\r\n" {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+
+	go handler.Cleanup()
+
+	reply, err := client.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading shutdown reply: %v", err)
+	}
+	if !strings.HasPrefix(reply, "421 4.3.2 ") {
+		t.Errorf("expected 421 shutdown reply, got %q", reply)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("expected Handle to return cleanly after cleanup, got %v", err)
+	}
+
+	// New sessions are turned away once the handler is draining.
+	mConn := &mockConn{readBuf: bytes.NewBufferString("EHLO late\r\n"), writeBuf: new(bytes.Buffer)}
+	if err := handler.Handle(layer4.WrapConnection(mConn, nil, nil), &mockNextHandler{}); err != nil {
+		t.Fatalf("Handle returned unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(mConn.writeBuf.String(), "421 4.3.2 ") {
+		t.Errorf("expected 421 for a session after cleanup, got %q", mConn.writeBuf.String())
+	}
+}
+
 func TestDrop220(t *testing.T) {
 	t.Run("drops 220 from being written", func(t *testing.T) {
 		mConn := &mockConn{
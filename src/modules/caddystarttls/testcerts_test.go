@@ -0,0 +1,102 @@
+package caddystarttls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertOptions describes a test certificate, see issue.
+type testCertOptions struct {
+	// DNS names; the first is also the common name. CAs only get the
+	// common name.
+	names []string
+	// Signs the certificate; self-signed if nil.
+	issuer    *x509.Certificate
+	issuerKey *ecdsa.PrivateKey
+	// Default: a day from now.
+	notAfter time.Time
+	ocspURL  string
+	isCA     bool
+	// For client instead of server authentication.
+	client bool
+}
+
+// issue creates the certificate with a new P-256 key. Its chain holds the
+// certificate followed by the issuer, if any.
+func (o testCertOptions) issue(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	notAfter := o.notAfter
+	if notAfter.IsZero() {
+		notAfter = time.Now().Add(24 * time.Hour)
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	if !notBefore.Before(notAfter) {
+		// Already expired.
+		notBefore = notAfter.Add(-24 * time.Hour)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: o.names[0]},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	switch {
+	case o.isCA:
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.BasicConstraintsValid = true
+		tmpl.IsCA = true
+	case o.client:
+		tmpl.DNSNames = o.names
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		tmpl.DNSNames = o.names
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if o.ocspURL != "" {
+		tmpl.OCSPServer = []string{o.ocspURL}
+	}
+
+	issuer, issuerKey := tmpl, key
+	if o.issuer != nil {
+		issuer, issuerKey = o.issuer, o.issuerKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if o.issuer != nil {
+		cert.Certificate = append(cert.Certificate, o.issuer.Raw)
+	}
+	return cert
+}
+
+// newTestCertificate returns a self-signed server certificate for names.
+func newTestCertificate(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	return testCertOptions{names: names}.issue(t)
+}
+
+// newTestCA returns a CA certificate and its key, signed by parent or, if
+// parent is nil, self-signed.
+func newTestCA(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	cert := testCertOptions{names: []string{name}, issuer: parent, issuerKey: parentKey, isCA: true}.issue(t)
+	return cert.Leaf, cert.PrivateKey.(*ecdsa.PrivateKey)
+}
@@ -0,0 +1,170 @@
+package caddystarttls
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchTLSFingerprint{})
+}
+
+// MatchTLSFingerprint matches connections whose TLS ClientHello has one of
+// the given JA3 or JA4 fingerprints, e.g. to route known spam bot TLS
+// stacks to a tarpit before custom_tls terminates the connection.
+//
+// The matcher reads the ClientHello the connection starts with. On STARTTLS
+// ports like 25 the ClientHello only follows the STARTTLS exchange, so match
+// in a subroute after the starttls handler, which hands the TLS session over
+// to the next handlers:
+//
+//	route {
+//		starttls
+//		subroute {
+//			@bots tls_fingerprint {
+//				ja4 <fingerprints...>
+//			}
+//			route @bots {
+//				close
+//			}
+//			route {
+//				custom_tls ...
+//			}
+//		}
+//	}
+type MatchTLSFingerprint struct {
+	// JA3 fingerprints (MD5 hashes) to match.
+	JA3 []string `json:"ja3,omitempty"`
+	// JA4 fingerprints to match.
+	JA4 []string `json:"ja4,omitempty"`
+}
+
+func (*MatchTLSFingerprint) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.tls_fingerprint",
+		New: func() caddy.Module { return new(MatchTLSFingerprint) },
+	}
+}
+
+// Match reads the ClientHello and compares its fingerprints. Connections
+// that do not start with a ClientHello do not match.
+func (m *MatchTLSFingerprint) Match(cx *layer4.Connection) (bool, error) {
+	msg, err := readClientHello(cx)
+	if errors.Is(err, errNotClientHello) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		return false, nil
+	}
+	return matchFingerprint(m.JA3, hello.ja3()) || matchFingerprint(m.JA4, hello.ja4()), nil
+}
+
+func matchFingerprint(fingerprints []string, fingerprint string) bool {
+	return slices.ContainsFunc(fingerprints, func(f string) bool {
+		return strings.EqualFold(f, fingerprint)
+	})
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	tls_fingerprint {
+//		ja3 <fingerprints...>
+//		ja4 <fingerprints...>
+//	}
+func (m *MatchTLSFingerprint) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "ja3", "ja4":
+				option := d.Val()
+				fingerprints := d.RemainingArgs()
+				if len(fingerprints) == 0 {
+					return d.ArgErr()
+				}
+				if option == "ja3" {
+					m.JA3 = append(m.JA3, fingerprints...)
+				} else {
+					m.JA4 = append(m.JA4, fingerprints...)
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	if len(m.JA3) == 0 && len(m.JA4) == 0 {
+		return d.Err("tls_fingerprint: ja3 or ja4 fingerprints are required")
+	}
+	return nil
+}
+
+// clientHelloRecorder records what the TLS server reads from a connection
+// until the ClientHello has been processed, so that custom_tls can
+// fingerprint it before the handshake continues.
+type clientHelloRecorder struct {
+	net.Conn
+	cx   *layer4.Connection
+	buf  []byte
+	done bool
+
+	hello    *clientHello
+	ja3, ja4 string
+
+	// Whether the connection holds a handshake slot, see
+	// CustomTLS.clientHelloReceived.
+	holdsSlot bool
+}
+
+func newClientHelloRecorder(cx *layer4.Connection) *clientHelloRecorder {
+	return &clientHelloRecorder{Conn: cx, cx: cx}
+}
+
+func (r *clientHelloRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if !r.done {
+		r.buf = append(r.buf, p[:n]...)
+		if len(r.buf) > maxClientHelloLen {
+			r.done, r.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// fingerprint stops recording and computes the fingerprints of the recorded
+// ClientHello. It is called by the TLS server once it has read the
+// ClientHello and publishes the fingerprints as {l4.tls.ja3} and
+// {l4.tls.ja4}.
+func (r *clientHelloRecorder) fingerprint() {
+	if r.done {
+		return
+	}
+	data := r.buf
+	r.done, r.buf = true, nil
+	msg, err := clientHelloMessage(data)
+	if err != nil {
+		return
+	}
+	if r.hello, err = parseClientHello(msg); err != nil {
+		return
+	}
+	r.ja3, r.ja4 = r.hello.ja3(), r.hello.ja4()
+	setFingerprintPlaceholders(r.cx, r.ja3, r.ja4)
+}
+
+// Interface guards
+var (
+	_ layer4.ConnMatcher    = (*MatchTLSFingerprint)(nil)
+	_ caddyfile.Unmarshaler = (*MatchTLSFingerprint)(nil)
+)
@@ -0,0 +1,171 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+func TestMatchTLSFingerprint(t *testing.T) {
+	clientCfg := &tls.Config{ServerName: "mail.example.com"}
+	hello, err := parseClientHello(captureClientHello(t, clientCfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		matcher MatchTLSFingerprint
+		input   []byte
+		want    bool
+	}{
+		{name: "ja3", matcher: MatchTLSFingerprint{JA3: []string{strings.ToUpper(hello.ja3())}}, want: true},
+		{name: "ja4", matcher: MatchTLSFingerprint{JA4: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1", hello.ja4()}}, want: true},
+		{name: "other fingerprint", matcher: MatchTLSFingerprint{JA4: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"}}},
+		{name: "not tls", matcher: MatchTLSFingerprint{JA3: []string{hello.ja3()}}, input: []byte("EHLO mail.example.com\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientEnd, serverEnd := net.Pipe()
+			defer serverEnd.Close()
+			go func() {
+				defer clientEnd.Close()
+				if tt.input != nil {
+					clientEnd.Write(tt.input)
+					return
+				}
+				tls.Client(clientEnd, clientCfg).Handshake()
+			}()
+			cx := layer4.WrapConnection(serverEnd, nil, nil)
+			got, err := tt.matcher.Match(cx)
+			if err != nil {
+				t.Fatalf("Match: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchTLSFingerprintAfterSTARTTLS(t *testing.T) {
+	clientCfg := &tls.Config{ServerName: "mail.example.com"}
+	hello, err := parseClientHello(captureClientHello(t, clientCfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := MatchTLSFingerprint{JA4: []string{hello.ja4()}}
+
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	go func() {
+		client := bufio.NewReader(clientEnd)
+		readReply := func() error {
+			for {
+				line, err := client.ReadString('\n')
+				if err != nil || len(line) < 4 || line[3] != '-' {
+					return err
+				}
+			}
+		}
+		// Read the greeting and each reply before sending the next line.
+		for _, cmd := range []string{"EHLO client.example.com\r\n", "STARTTLS\r\n"} {
+			if readReply() != nil {
+				return
+			}
+			clientEnd.Write([]byte(cmd))
+		}
+		if readReply() != nil {
+			return
+		}
+		tls.Client(clientEnd, clientCfg).Handshake()
+	}()
+
+	var matched bool
+	next := layer4.HandlerFunc(func(cx *layer4.Connection) error {
+		defer cx.Close()
+		matched, err = matcher.Match(cx)
+		return err
+	})
+	handler := &StartTLS{logger: zap.NewNop()}
+	if err := handler.Handle(layer4.WrapConnection(serverEnd, nil, nil), next); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if !matched {
+		t.Error("expected the ClientHello after STARTTLS to match")
+	}
+}
+
+func TestCustomTLSFingerprintPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	c := &CustomTLS{CertPath: certPath, KeyPath: keyPath, ReloadInterval: -1}
+	provisionCustomTLS(t, c)
+
+	clientCfg := &tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}
+	hello, err := parseClientHello(captureClientHello(t, clientCfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cx, err := handshakeCustomTLS(t, c, clientCfg)
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	// Go clients randomize their extension order, which changes JA3 but not JA4.
+	if got, _ := repl.GetString("l4.tls.ja4"); got != hello.ja4() {
+		t.Errorf("{l4.tls.ja4} = %s, want %s", got, hello.ja4())
+	}
+	if got, _ := repl.GetString("l4.tls.ja3"); len(got) != 32 {
+		t.Errorf("{l4.tls.ja3} = %q, want an MD5 hash", got)
+	}
+}
+
+func TestMatchTLSFingerprintUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    MatchTLSFingerprint
+		wantErr bool
+	}{
+		{
+			name: "ja3 and ja4",
+			input: `tls_fingerprint {
+				ja3 ada70206e40642a3e4461f35503241d5
+				ja4 t13d1516h2_8daaf6152771_e5627efa2ab1 t12d0909h1_0f3c9d6f8d35_2b2e4d5c1f1a
+			}`,
+			want: MatchTLSFingerprint{
+				JA3: []string{"ada70206e40642a3e4461f35503241d5"},
+				JA4: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1", "t12d0909h1_0f3c9d6f8d35_2b2e4d5c1f1a"},
+			},
+		},
+		{name: "no fingerprints", input: `tls_fingerprint`, wantErr: true},
+		{
+			name: "unknown option",
+			input: `tls_fingerprint {
+				ja5 abc
+			}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m MatchTLSFingerprint
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(m, tt.want) {
+				t.Errorf("UnmarshalCaddyfile() = %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package caddystarttls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// setTLSPlaceholders makes the details of a completed handshake available
+// as {l4.tls.*} placeholders to later handlers on the connection:
+//
+//	{l4.tls.server_name}                   SNI, or default_sni if the client sent none
+//	{l4.tls.version}                       e.g. tls1.3
+//	{l4.tls.cipher_suite}                  e.g. TLS_AES_128_GCM_SHA256
+//	{l4.tls.proto}                         negotiated ALPN protocol
+//	{l4.tls.resumed}                       whether the session was resumed
+//	{l4.tls.ech_accepted}                  whether the ClientHello was encrypted with ECH
+//	{l4.tls.client.subject}                client certificate subject
+//	{l4.tls.client.issuer}                 client certificate issuer
+//	{l4.tls.client.serial}                 client certificate serial number
+//	{l4.tls.client.fingerprint}            SHA-256 of the client certificate, hex
+//	{l4.tls.client.certificate_pem}        client certificate, PEM
+//	{l4.tls.client.certificate_der_base64} client certificate, base64 DER
+//	{l4.tls.client.san.dns_names}          comma-separated SANs; also emails, ips and uris
+//
+// The client placeholders are only set if the client sent a certificate.
+// See setFingerprintPlaceholders for the ClientHello fingerprints.
+func setTLSPlaceholders(cx *layer4.Connection, state *tls.ConnectionState) {
+	repl, ok := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+
+	repl.Set("l4.tls.server_name", state.ServerName)
+	repl.Set("l4.tls.version", caddytls.ProtocolName(state.Version))
+	repl.Set("l4.tls.cipher_suite", tls.CipherSuiteName(state.CipherSuite))
+	repl.Set("l4.tls.proto", state.NegotiatedProtocol)
+	repl.Set("l4.tls.resumed", state.DidResume)
+	repl.Set("l4.tls.ech_accepted", state.ECHAccepted)
+
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	repl.Set("l4.tls.client.subject", cert.Subject.String())
+	repl.Set("l4.tls.client.issuer", cert.Issuer.String())
+	repl.Set("l4.tls.client.serial", cert.SerialNumber.String())
+	repl.Set("l4.tls.client.fingerprint", hex.EncodeToString(fingerprint[:]))
+	repl.Set("l4.tls.client.certificate_pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	repl.Set("l4.tls.client.certificate_der_base64", base64.StdEncoding.EncodeToString(cert.Raw))
+	repl.Set("l4.tls.client.san.dns_names", strings.Join(cert.DNSNames, ","))
+	repl.Set("l4.tls.client.san.emails", strings.Join(cert.EmailAddresses, ","))
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	repl.Set("l4.tls.client.san.ips", strings.Join(ips, ","))
+
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	repl.Set("l4.tls.client.san.uris", strings.Join(uris, ","))
+}
+
+// setFingerprintPlaceholders makes the fingerprints of the client's
+// ClientHello available as placeholders, before the handshake completes:
+//
+//	{l4.tls.ja3} JA3 fingerprint, MD5 hex
+//	{l4.tls.ja4} JA4 fingerprint
+func setFingerprintPlaceholders(cx *layer4.Connection, ja3, ja4 string) {
+	repl, ok := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set("l4.tls.ja3", ja3)
+	repl.Set("l4.tls.ja4", ja4)
+}
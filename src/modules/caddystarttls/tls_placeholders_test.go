@@ -0,0 +1,64 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func TestCustomTLSPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir, "mail", newTestCertificate(t, "mail.example.com"))
+	ca, caKey := newTestCA(t, "Device CA", nil, nil)
+	poolPath := filepath.Join(dir, "devices.pem")
+	if err := os.WriteFile(poolPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	device := testCertOptions{names: []string{"plc-01"}, issuer: ca, issuerKey: caKey, client: true}.issue(t)
+
+	c := &CustomTLS{
+		CertPath:       certPath,
+		KeyPath:        keyPath,
+		DefaultSNI:     "mail.example.com",
+		ALPN:           []string{"smtp"},
+		ClientAuth:     &ClientAuth{TrustPoolFiles: []string{poolPath}},
+		ReloadInterval: -1,
+	}
+	provisionCustomTLS(t, c)
+
+	_, cx, err := handshakeCustomTLS(t, c, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{"smtp"},
+		Certificates:       []tls.Certificate{device},
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+
+	repl := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	tests := map[string]string{
+		"{l4.tls.server_name}":    "mail.example.com",
+		"{l4.tls.version}":        "tls1.3",
+		"{l4.tls.proto}":          "smtp",
+		"{l4.tls.resumed}":        "false",
+		"{l4.tls.client.subject}": "CN=plc-01",
+		"{l4.tls.client.issuer}":  "CN=Device CA",
+	}
+	for placeholder, want := range tests {
+		if got := repl.ReplaceAll(placeholder, "<unset>"); got != want {
+			t.Errorf("%s = %q, want %q", placeholder, got, want)
+		}
+	}
+	if got := repl.ReplaceAll("{l4.tls.cipher_suite}", ""); got == "" {
+		t.Error("{l4.tls.cipher_suite} is empty")
+	}
+	if got := repl.ReplaceAll("{l4.tls.client.fingerprint}", ""); len(got) != 64 {
+		t.Errorf("{l4.tls.client.fingerprint} = %q, want a hex SHA-256", got)
+	}
+}
@@ -0,0 +1,120 @@
+package caddystarttls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+// Named TLS profiles.
+const (
+	// profileModern allows TLS 1.3 only.
+	profileModern = "modern"
+	// profileIntermediate allows TLS 1.2 and later with AEAD cipher suites only.
+	profileIntermediate = "intermediate"
+	// profileLegacySMTP additionally allows the CBC cipher suites that older
+	// mail clients and checkers such as checktls.com still rely on.
+	profileLegacySMTP = "legacy_smtp"
+)
+
+// tlsProfile holds the protocol settings a named profile stands for.
+type tlsProfile struct {
+	minVersion uint16
+	maxVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	profileModern: {
+		minVersion: tls.VersionTLS13,
+		curves:     []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	profileIntermediate: {
+		minVersion: tls.VersionTLS12,
+		ciphers: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	},
+	profileLegacySMTP: {
+		minVersion: tls.VersionTLS12,
+		ciphers: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		},
+	},
+}
+
+// applyTLSProfile configures cfg from the named profile and then applies
+// the explicitly configured protocols, cipher suites and curves on top.
+// Names are the ones Caddy's tls connection policies use.
+func (c *CustomTLS) applyTLSProfile(cfg *tls.Config) error {
+	name := c.Profile
+	if name == "" {
+		name = profileLegacySMTP
+	}
+	profile, ok := tlsProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown TLS profile %q", c.Profile)
+	}
+	cfg.MinVersion = profile.minVersion
+	cfg.MaxVersion = profile.maxVersion
+	cfg.CipherSuites = profile.ciphers
+	cfg.CurvePreferences = profile.curves
+
+	if c.ProtocolMin != "" {
+		v, ok := caddytls.SupportedProtocols[c.ProtocolMin]
+		if !ok {
+			return fmt.Errorf("protocol_min: unsupported protocol %q", c.ProtocolMin)
+		}
+		cfg.MinVersion = v
+	}
+	if c.ProtocolMax != "" {
+		v, ok := caddytls.SupportedProtocols[c.ProtocolMax]
+		if !ok {
+			return fmt.Errorf("protocol_max: unsupported protocol %q", c.ProtocolMax)
+		}
+		cfg.MaxVersion = v
+	}
+	if cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("protocol_min %s is greater than protocol_max %s",
+			caddytls.ProtocolName(cfg.MinVersion), caddytls.ProtocolName(cfg.MaxVersion))
+	}
+
+	if len(c.CipherSuites) > 0 {
+		cfg.CipherSuites = nil
+		for _, name := range c.CipherSuites {
+			if !caddytls.CipherSuiteNameSupported(name) {
+				return fmt.Errorf("cipher_suites: unsupported cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, caddytls.CipherSuiteID(name))
+		}
+	}
+
+	if len(c.Curves) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range c.Curves {
+			id, ok := caddytls.SupportedCurves[strings.ToLower(name)]
+			if !ok {
+				return fmt.Errorf("curves: unsupported curve %q", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	return nil
+}
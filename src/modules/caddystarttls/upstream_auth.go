@@ -0,0 +1,290 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UpstreamAuth holds the credentials used to authenticate to the upstream
+// after the TLS handshake, turning the proxy into an authenticated relay
+// for clients that cannot do SMTP AUTH themselves.
+type UpstreamAuth struct {
+	// Username to authenticate with. Supports global placeholders like {env.SMTP_USER}.
+	Username string `json:"username,omitempty"`
+
+	// Password to authenticate with. Supports global placeholders like {env.SMTP_PASSWORD}.
+	Password string `json:"password,omitempty"`
+
+	// SASL mechanism to use: "plain" or "login". If empty, PLAIN is
+	// preferred and LOGIN is used when the upstream only offers that.
+	Mechanism string `json:"mechanism,omitempty"`
+
+	username string
+	password string
+}
+
+// provision resolves placeholders in the credentials and validates the mechanism.
+func (a *UpstreamAuth) provision() error {
+	repl := caddy.NewReplacer()
+	a.username = repl.ReplaceKnown(a.Username, "")
+	a.password = repl.ReplaceKnown(a.Password, "")
+	if a.username == "" {
+		return fmt.Errorf("auth: username is required")
+	}
+
+	a.Mechanism = strings.ToLower(a.Mechanism)
+	switch a.Mechanism {
+	case "", "plain", "login":
+	default:
+		return fmt.Errorf("auth: unsupported mechanism %q", a.Mechanism)
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses either `auth <username> <password>` or an auth block.
+func (a *UpstreamAuth) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 2:
+		a.Username = args[0]
+		a.Password = args[1]
+	default:
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Password = d.Val()
+		case "mechanism":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Mechanism = d.Val()
+		default:
+			return d.Errf("unrecognized auth option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// authenticate runs the SASL exchange on an established upstream session.
+// ehloResp is the upstream's reply to the EHLO sent after the TLS handshake.
+func (a *UpstreamAuth) authenticate(w io.Writer, reader *bufio.Reader, ehloResp string) error {
+	caps := parseEHLOCapabilities(ehloResp)
+	if !caps.has("AUTH") {
+		return fmt.Errorf("upstream does not advertise AUTH")
+	}
+	offered := make(map[string]bool)
+	for _, m := range caps["AUTH"] {
+		offered[strings.ToUpper(m)] = true
+	}
+
+	mechanism := a.Mechanism
+	if mechanism == "" {
+		switch {
+		case offered["PLAIN"]:
+			mechanism = "plain"
+		case offered["LOGIN"]:
+			mechanism = "login"
+		default:
+			return fmt.Errorf("upstream offers no supported AUTH mechanism")
+		}
+	} else if !offered[strings.ToUpper(mechanism)] {
+		return fmt.Errorf("upstream does not offer AUTH %s", strings.ToUpper(mechanism))
+	}
+
+	var resp string
+	var err error
+	switch mechanism {
+	case "plain":
+		token := base64.StdEncoding.EncodeToString([]byte("\x00" + a.username + "\x00" + a.password))
+		resp, err = smtpCommand(w, reader, "AUTH PLAIN "+token)
+	case "login":
+		resp, err = smtpCommand(w, reader, "AUTH LOGIN")
+		if err == nil && strings.HasPrefix(resp, "334") {
+			resp, err = smtpCommand(w, reader, base64.StdEncoding.EncodeToString([]byte(a.username)))
+		}
+		if err == nil && strings.HasPrefix(resp, "334") {
+			resp, err = smtpCommand(w, reader, base64.StdEncoding.EncodeToString([]byte(a.password)))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("AUTH %s: %w", strings.ToUpper(mechanism), err)
+	}
+	if !strings.HasPrefix(resp, "235") {
+		return fmt.Errorf("AUTH %s rejected: %s", strings.ToUpper(mechanism), strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// smtpCommand writes a single command line and reads the full response.
+func smtpCommand(w io.Writer, reader *bufio.Reader, cmd string) (string, error) {
+	if _, err := fmt.Fprintf(w, "%s\r\n", cmd); err != nil {
+		return "", err
+	}
+	return readSMTPResponse(reader)
+}
+
+// filterEHLOKeywords removes the given extensions from a 250 EHLO response, e.g.
+// AUTH so that clients do not try to authenticate on a session the proxy already
+// authenticated. Other responses are returned unchanged.
+func filterEHLOKeywords(resp string, keywords ...string) string {
+	lines := strings.SplitAfter(resp, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "250") {
+		return resp
+	}
+
+	kept := lines[:1:1]
+	for _, line := range lines[1:] {
+		if len(line) >= 4 && hasEHLOKeyword(line[4:], keywords) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	// Fix up continuation markers, since the final line may have been removed.
+	var sb strings.Builder
+	for i, line := range kept {
+		if len(line) >= 4 && (line[3] == '-' || line[3] == ' ') {
+			sep := "-"
+			if i == len(kept)-1 {
+				sep = " "
+			}
+			line = line[:3] + sep + line[4:]
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// hasEHLOKeyword reports whether an EHLO extension line starts with one of keywords.
+func hasEHLOKeyword(ext string, keywords []string) bool {
+	fields := strings.Fields(ext)
+	if len(fields) == 0 {
+		return false
+	}
+	keyword, _, _ := strings.Cut(strings.ToUpper(fields[0]), "=")
+	for _, k := range keywords {
+		if keyword == k {
+			return true
+		}
+	}
+	return false
+}
+
+// smtpCommands follows the commands a client sends on a proxied session, so
+// that each upstream response can be matched to the command it answers, also
+// when commands are pipelined (RFC 2920).
+type smtpCommands struct {
+	mu      sync.Mutex
+	pending []string // Verbs of the commands not answered yet, oldest first
+	inData  bool     // The client is sending a message after DATA was accepted
+}
+
+// sent records a line the client sent and returns the size of the BDAT
+// chunk that follows it, if any.
+func (c *smtpCommands) sent(line string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inData {
+		if line == ".\r\n" || line == ".\n" {
+			// The end of the message is answered like a command.
+			c.inData = false
+			c.pending = append(c.pending, ".")
+		}
+		return 0
+	}
+	var verb string
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		verb = strings.ToUpper(fields[0])
+	}
+	c.pending = append(c.pending, verb)
+	if verb == "BDAT" && len(fields) > 1 {
+		if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil && size > 0 {
+			return size
+		}
+	}
+	return 0
+}
+
+// answered removes the oldest pending command, which resp answers, and
+// returns its verb, or "" if no command is pending.
+func (c *smtpCommands) answered(resp string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return ""
+	}
+	verb := c.pending[0]
+	c.pending = c.pending[1:]
+	if verb == "DATA" && strings.HasPrefix(resp, "354") {
+		// Set before the client sees the 354, so before it sends the message.
+		c.inData = true
+	}
+	return verb
+}
+
+// copySMTPCommands copies the client's commands and messages to dst and
+// records the commands in c.
+func copySMTPCommands(dst io.Writer, src *bufio.Reader, c *smtpCommands) error {
+	var chunk int64 // Bytes of a BDAT chunk still to copy
+	for {
+		if chunk > 0 {
+			n, err := io.CopyN(dst, src, chunk)
+			chunk -= n
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		line, err := src.ReadString('\n')
+		if len(line) > 0 {
+			if _, err := io.WriteString(dst, line); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		chunk = c.sent(line)
+	}
+}
+
+// copySMTPResponses copies upstream responses to the client one complete
+// response at a time, removing the hidden extensions from responses to EHLO.
+func copySMTPResponses(dst io.Writer, src *bufio.Reader, c *smtpCommands, hidden []string) error {
+	for {
+		resp, err := readSMTPResponse(src)
+		if err != nil {
+			return err
+		}
+		if c.answered(resp) == "EHLO" {
+			resp = filterEHLOKeywords(resp, hidden...)
+		}
+		if _, err := io.WriteString(dst, resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testEHLOResponse = "250-mail.corp Hello\r\n250-SIZE 35882577\r\n250-AUTH LOGIN PLAIN\r\n250 8BITMIME\r\n"
+
+func TestUpstreamAuthAuthenticate(t *testing.T) {
+	tests := []struct {
+		name        string
+		mechanism   string
+		ehlo        string
+		upstream    string
+		expectedOut string
+		expectErr   bool
+	}{
+		{
+			name:        "PLAIN preferred when offered",
+			ehlo:        testEHLOResponse,
+			upstream:    "235 2.7.0 Authentication successful\r\n",
+			expectedOut: "AUTH PLAIN AHJlbGF5AHNlY3JldA==\r\n",
+		},
+		{
+			name:        "LOGIN exchange",
+			mechanism:   "login",
+			ehlo:        testEHLOResponse,
+			upstream:    "334 VXNlcm5hbWU6\r\n334 UGFzc3dvcmQ6\r\n235 2.7.0 Authentication successful\r\n",
+			expectedOut: "AUTH LOGIN\r\ncmVsYXk=\r\nc2VjcmV0\r\n",
+		},
+		{
+			name:      "rejected credentials",
+			ehlo:      testEHLOResponse,
+			upstream:  "535 5.7.8 Authentication credentials invalid\r\n",
+			expectErr: true,
+		},
+		{
+			name:      "AUTH not advertised",
+			ehlo:      "250-mail.corp Hello\r\n250 8BITMIME\r\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &UpstreamAuth{Username: "relay", Password: "secret", Mechanism: tt.mechanism}
+			if err := auth.provision(); err != nil {
+				t.Fatalf("provision returned unexpected error: %v", err)
+			}
+
+			out := new(bytes.Buffer)
+			err := auth.authenticate(out, bufio.NewReader(strings.NewReader(tt.upstream)), tt.ehlo)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate returned unexpected error: %v", err)
+			}
+			if out.String() != tt.expectedOut {
+				t.Errorf("expected commands %q, got %q", tt.expectedOut, out.String())
+			}
+		})
+	}
+}
+
+func TestFilterEHLOKeywords(t *testing.T) {
+	tests := []struct {
+		name     string
+		resp     string
+		expected string
+	}{
+		{
+			name:     "AUTH in the middle",
+			resp:     testEHLOResponse,
+			expected: "250-mail.corp Hello\r\n250-SIZE 35882577\r\n250 8BITMIME\r\n",
+		},
+		{
+			name:     "AUTH as the final line",
+			resp:     "250-mail.corp Hello\r\n250-SIZE 35882577\r\n250-AUTH=LOGIN\r\n250 AUTH LOGIN\r\n",
+			expected: "250-mail.corp Hello\r\n250 SIZE 35882577\r\n",
+		},
+		{
+			name:     "bare final line",
+			resp:     "250-mail.corp Hello\r\n250-AUTH LOGIN\r\n250\r\n",
+			expected: "250-mail.corp Hello\r\n250\r\n",
+		},
+		{
+			name:     "non-EHLO response untouched",
+			resp:     "354 Start mail input\r\n",
+			expected: "354 Start mail input\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filterEHLOKeywords(tt.resp, "AUTH"); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCopySMTPResponsesFiltersEHLOOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		responses string
+		expected  string
+	}{
+		{
+			name:      "pipelined commands",
+			client:    "VRFY postmaster\r\nEHLO client\r\n",
+			responses: "250-AUTH is part of the text\r\n250 <postmaster@corp>\r\n" + testEHLOResponse,
+			expected:  "250-AUTH is part of the text\r\n250 <postmaster@corp>\r\n250-mail.corp Hello\r\n250-SIZE 35882577\r\n250 8BITMIME\r\n",
+		},
+		{
+			name:      "BDAT chunk that looks like EHLO",
+			client:    "BDAT 12 LAST\r\nEHLO x\r\nabcdNOOP\r\n",
+			responses: "250-AUTH is part of the text\r\n250 queued\r\n250 ok\r\n",
+			expected:  "250-AUTH is part of the text\r\n250 queued\r\n250 ok\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(smtpCommands)
+			var upstream bytes.Buffer
+			copySMTPCommands(&upstream, bufio.NewReader(strings.NewReader(tt.client)), c)
+			if upstream.String() != tt.client {
+				t.Errorf("expected the client input to be copied unchanged, got %q", upstream.String())
+			}
+			var out bytes.Buffer
+			copySMTPResponses(&out, bufio.NewReader(strings.NewReader(tt.responses)), c, []string{"AUTH"})
+			if out.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestSMTPCommandsMessageData(t *testing.T) {
+	c := new(smtpCommands)
+	c.sent("DATA\r\n")
+	if verb := c.answered("354 Start mail input\r\n"); verb != "DATA" {
+		t.Fatalf("expected the 354 to answer DATA, got %q", verb)
+	}
+	// Message lines are no commands, whatever they look like.
+	c.sent("EHLO in the message body\r\n")
+	c.sent(".\r\n")
+	if verb := c.answered("250 queued\r\n"); verb != "." {
+		t.Errorf("expected the end of the message to be answered, got %q", verb)
+	}
+	c.sent("EHLO client\r\n")
+	if verb := c.answered(testEHLOResponse); verb != "EHLO" {
+		t.Errorf("expected the EHLO after the message to be answered, got %q", verb)
+	}
+}
@@ -0,0 +1,362 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+// defaultAttemptDelay is the Connection Attempt Delay recommended by RFC 8305.
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// dialAttempt is one upstream target to try for a session.
+type dialAttempt struct {
+	up     *Upstream
+	target upstreamTarget
+}
+
+// attemptResult is the outcome of a dialAttempt.
+type attemptResult struct {
+	attempt dialAttempt
+	session *upstreamSession
+	err     error
+}
+
+// parallelDials returns how many upstreams are raced for each session.
+func (u *UpstreamSTARTTLS) parallelDials() int {
+	if u.ParallelDials > 1 {
+		return u.ParallelDials
+	}
+	return 1
+}
+
+// racing reports whether attempts are started staggered instead of strictly
+// one after another.
+func (u *UpstreamSTARTTLS) racing() bool {
+	return u.ParallelDials > 1 || u.HappyEyeballs
+}
+
+// dialBatch resolves the given upstreams and returns the first session
+// that is ready to be proxied.
+func (u *UpstreamSTARTTLS) dialBatch(cx *layer4.Connection, batch []*Upstream) (*upstreamSession, error) {
+	var attempts []dialAttempt
+	var lastErr error
+	for _, up := range batch {
+		targets, err := u.targets(cx, up)
+		if err == nil && u.HappyEyeballs {
+			targets, err = u.expandHostnames(cx.Context, targets)
+		}
+		if err != nil {
+			u.logger.Error("resolving upstream failed", zap.String("upstream", up.Address), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		for _, target := range targets {
+			attempts = append(attempts, dialAttempt{up: up, target: target})
+		}
+	}
+	if len(attempts) == 0 {
+		return nil, lastErr
+	}
+
+	var delay time.Duration
+	if u.racing() {
+		delay = time.Duration(u.AttemptDelay)
+		if u.HappyEyeballs {
+			attempts = interleaveFamilies(attempts)
+		}
+	}
+	return u.race(cx.Context, attempts, delay)
+}
+
+// race runs the attempts in order and returns the first session that is
+// ready. Each attempt starts when the previous one failed or, if delay is
+// positive, after delay has passed, as in RFC 8305. A delay of zero tries
+// the attempts strictly one after another. Attempts that are still running
+// when one succeeds are cancelled.
+func (u *UpstreamSTARTTLS) race(ctx context.Context, attempts []dialAttempt, delay time.Duration) (*upstreamSession, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attemptResult, len(attempts))
+	started, pending := 0, 0
+	start := func() {
+		a := attempts[started]
+		started++
+		pending++
+		go func() {
+			session, err := u.connect(ctx, a.up, a.target)
+			results <- attemptResult{attempt: a, session: session, err: err}
+		}()
+	}
+
+	var lastErr error
+	for pending > 0 || started < len(attempts) {
+		if pending == 0 {
+			start()
+			continue
+		}
+
+		var stagger <-chan time.Time
+		if delay > 0 && started < len(attempts) {
+			stagger = time.After(delay)
+		}
+
+		select {
+		case <-stagger:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Attempts that still finish after the winner are closed.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.session != nil {
+							late.session.close()
+						}
+					}
+				}(pending)
+				return r.session, nil
+			}
+			u.logger.Error("upstream connection failed",
+				zap.String("upstream", r.attempt.up.Address),
+				zap.String("target", r.attempt.target.address),
+				zap.Error(r.err))
+			lastErr = r.err
+			// Start the next attempt right away instead of waiting out the delay.
+			if started < len(attempts) {
+				start()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// expandHostnames resolves static hostname targets into one target per
+// address, so that IPv4 and IPv6 can be raced against each other. The
+// handler's resolver is used, so the answers are cached for their TTL.
+func (u *UpstreamSTARTTLS) expandHostnames(ctx context.Context, targets []upstreamTarget) ([]upstreamTarget, error) {
+	expanded := make([]upstreamTarget, 0, len(targets))
+	for _, t := range targets {
+		host, port, err := net.SplitHostPort(t.address)
+		if err != nil || net.ParseIP(host) != nil {
+			expanded = append(expanded, t)
+			continue
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+		ips, err := u.resolver.lookupHost(lookupCtx, host)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("looking up %s: %w", host, err)
+		}
+		for _, ip := range ips {
+			expanded = append(expanded, upstreamTarget{
+				network:    t.network,
+				address:    net.JoinHostPort(ip, port),
+				serverName: t.serverName,
+			})
+		}
+	}
+	return expanded, nil
+}
+
+// interleaveFamilies reorders attempts so that IPv6 and IPv4 addresses
+// alternate, starting with IPv6 if there is any (RFC 8305 section 4).
+// Attempts that are not IP addresses count as IPv4.
+func interleaveFamilies(attempts []dialAttempt) []dialAttempt {
+	var first, second []dialAttempt
+	firstIsV6 := slices.ContainsFunc(attempts, func(a dialAttempt) bool { return isIPv6Target(a.target) })
+	for _, a := range attempts {
+		if isIPv6Target(a.target) == firstIsV6 {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+
+	out := make([]dialAttempt, 0, len(attempts))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			out = append(out, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			out = append(out, second[0])
+			second = second[1:]
+		}
+	}
+	return out
+}
+
+// isIPv6Target reports whether the target address is an IPv6 literal.
+func isIPv6Target(t upstreamTarget) bool {
+	host, _, err := net.SplitHostPort(t.address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// egressDialer dials upstreams from the configured source address with the
+// configured TCP options, optionally through a SOCKS5 or HTTP CONNECT proxy.
+// The zero value dials directly with Go's defaults.
+type egressDialer struct {
+	dialer  net.Dialer
+	noDelay *bool
+	proxy   *url.URL
+}
+
+// newEgressDialer builds a dialer for the given egress options, as
+// configured on upstream_starttls or for the probes of starttls.
+func newEgressDialer(localAddress, proxyAddr string, keepAlive caddy.Duration, noDelay *bool) (egressDialer, error) {
+	var d egressDialer
+	d.dialer.KeepAlive = time.Duration(keepAlive)
+	d.noDelay = noDelay
+
+	if localAddress != "" {
+		host := localAddress
+		port := "0"
+		if h, p, err := net.SplitHostPort(localAddress); err == nil {
+			host, port = h, p
+		}
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return d, fmt.Errorf("invalid local_address %q: %v", localAddress, err)
+		}
+		d.dialer.LocalAddr = addr
+	}
+
+	if proxyAddr != "" {
+		proxyURL, err := url.Parse(proxyAddr)
+		if err != nil {
+			return d, fmt.Errorf("invalid proxy %q: %v", proxyAddr, err)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return d, fmt.Errorf("unsupported proxy scheme %q, expected socks5 or http", proxyURL.Scheme)
+		}
+		if proxyURL.Port() == "" {
+			return d, fmt.Errorf("proxy %q must include a port", proxyAddr)
+		}
+		d.proxy = proxyURL
+	}
+	return d, nil
+}
+
+// dial connects to the upstream address, through the egress proxy if one
+// is configured. Unix sockets are always dialed directly.
+func (d *egressDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if isUnixNetwork(network) {
+		var unixDialer net.Dialer
+		return unixDialer.DialContext(ctx, network, address)
+	}
+	if d.proxy == nil {
+		return d.DialContext(ctx, network, address)
+	}
+
+	switch d.proxy.Scheme {
+	case "http":
+		return d.dialHTTPConnect(ctx, address)
+	default:
+		var auth *proxy.Auth
+		if d.proxy.User != nil {
+			password, _ := d.proxy.User.Password()
+			auth = &proxy.Auth{User: d.proxy.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", d.proxy.Host, auth, d)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, network, address)
+	}
+}
+
+// DialContext dials a TCP connection without the egress proxy and applies
+// the TCP options. It is also the forward dialer for the SOCKS5 client.
+func (d *egressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && d.noDelay != nil {
+		tcpConn.SetNoDelay(*d.noDelay)
+	}
+	return conn, nil
+}
+
+// Dial implements proxy.Dialer.
+func (d *egressDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// dialHTTPConnect opens a tunnel to address through an HTTP proxy.
+func (d *egressDialer) dialHTTPConnect(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %s: %w", d.proxy.Host, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	reader := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(reader, req)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, context.Cause(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %w", address, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %s", address, resp.Status)
+	}
+
+	// The upstream may already have sent its greeting along with the proxy response.
+	if n := reader.Buffered(); n > 0 {
+		buf, _ := reader.Peek(n)
+		return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}, nil
+	}
+	return conn, nil
+}
+
+// isUnixNetwork reports whether network is one of the unix socket networks.
+func isUnixNetwork(network string) bool {
+	return strings.HasPrefix(network, "unix")
+}
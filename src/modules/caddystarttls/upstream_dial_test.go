@@ -0,0 +1,199 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	tests := []struct {
+		addresses []string
+		expected  string
+	}{
+		{
+			addresses: []string{"[2001:db8::1]:25", "[2001:db8::2]:25", "192.0.2.1:25", "192.0.2.2:25", "192.0.2.3:25"},
+			expected:  "[2001:db8::1]:25 192.0.2.1:25 [2001:db8::2]:25 192.0.2.2:25 192.0.2.3:25",
+		},
+		{
+			// IPv6 goes first even if IPv4 was resolved first.
+			addresses: []string{"192.0.2.1:25", "192.0.2.2:25", "[2001:db8::1]:25"},
+			expected:  "[2001:db8::1]:25 192.0.2.1:25 192.0.2.2:25",
+		},
+		{
+			addresses: []string{"192.0.2.1:25", "mx.example.com:25"},
+			expected:  "192.0.2.1:25 mx.example.com:25",
+		},
+	}
+	for _, tt := range tests {
+		var attempts []dialAttempt
+		for _, addr := range tt.addresses {
+			attempts = append(attempts, dialAttempt{target: upstreamTarget{address: addr}})
+		}
+		var got []string
+		for _, a := range interleaveFamilies(attempts) {
+			got = append(got, a.target.address)
+		}
+		if strings.Join(got, " ") != tt.expected {
+			t.Errorf("expected order %q, got %q", tt.expected, strings.Join(got, " "))
+		}
+	}
+}
+
+func TestExpandHostnames(t *testing.T) {
+	addr, queries := startTestDNSServer(t)
+	r, err := newDNSResolver([]string{addr})
+	if err != nil {
+		t.Fatalf("newDNSResolver returned unexpected error: %v", err)
+	}
+	u := &UpstreamSTARTTLS{resolver: r}
+	targets := []upstreamTarget{
+		{network: "tcp", address: "dual.corp.example:25", serverName: "dual.corp.example"},
+		{network: "tcp", address: "broken6.corp.example:25", serverName: "broken6.corp.example"},
+		{network: "tcp", address: "192.0.2.1:25", serverName: "192.0.2.1"},
+	}
+
+	// IPv6 first, and the IPv4 address of broken6 despite its failing AAAA query.
+	expected := []upstreamTarget{
+		{network: "tcp", address: "[2001:db8::3]:25", serverName: "dual.corp.example"},
+		{network: "tcp", address: "10.0.0.3:25", serverName: "dual.corp.example"},
+		{network: "tcp", address: "10.0.0.4:25", serverName: "broken6.corp.example"},
+		{network: "tcp", address: "192.0.2.1:25", serverName: "192.0.2.1"},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := u.expandHostnames(context.Background(), targets)
+		if err != nil {
+			t.Fatalf("expandHostnames returned unexpected error: %v", err)
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d targets, got %+v", len(expected), got)
+		}
+		for j := range expected {
+			if got[j] != expected[j] {
+				t.Errorf("target %d: expected %+v, got %+v", j, expected[j], got[j])
+			}
+		}
+	}
+	// The second expansion is answered from the resolver's cache, except for
+	// the failed AAAA query of broken6, which is not cached.
+	if n := atomic.LoadInt32(queries); n != 5 {
+		t.Errorf("expected 5 queries, got %d", n)
+	}
+}
+
+func TestUpstreamSTARTTLSRace(t *testing.T) {
+	// An upstream that accepts connections but never sends a greeting.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	u := &UpstreamSTARTTLS{TLSPolicy: tlsPolicyOpportunistic, logger: zap.NewNop()}
+	attempts := []dialAttempt{
+		{up: &Upstream{Address: "silent"}, target: upstreamTarget{network: "tcp", address: silent.Addr().String()}},
+		{up: &Upstream{Address: "healthy"}, target: upstreamTarget{network: "tcp", address: strings.TrimPrefix(startPlaintextUpstream(t), "tcp/")}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	session, err := u.race(ctx, attempts, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("race returned unexpected error: %v", err)
+	}
+	defer session.close()
+
+	if session.up.Address != "healthy" {
+		t.Errorf("expected the healthy upstream to win, got %s", session.up.Address)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the race to finish quickly, took %v", elapsed)
+	}
+}
+
+func TestEgressDialerHTTPConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		// Send the upstream greeting in the same write as the proxy response.
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n220 upstream ESMTP\r\n"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	d, err := newEgressDialer("", "http://relay:secret@"+ln.Addr().String(), 0, nil)
+	if err != nil {
+		t.Fatalf("newEgressDialer returned unexpected error: %v", err)
+	}
+
+	conn, err := d.dial(context.Background(), "tcp", "smtp.example.com:587")
+	if err != nil {
+		t.Fatalf("dial returned unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "smtp.example.com:587" {
+		t.Errorf("expected CONNECT smtp.example.com:587, got %s %s", req.Method, req.Host)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "Basic cmVsYXk6c2VjcmV0" {
+		t.Errorf("unexpected Proxy-Authorization %q", got)
+	}
+
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading greeting through tunnel: %v", err)
+	}
+	if greeting != "220 upstream ESMTP\r\n" {
+		t.Errorf("expected buffered greeting to be preserved, got %q", greeting)
+	}
+}
+
+func TestUpstreamSTARTTLSUnixTarget(t *testing.T) {
+	u := &UpstreamSTARTTLS{logger: zap.NewNop()}
+	cx := layer4.WrapConnection(&mockConn{readBuf: new(bytes.Buffer), writeBuf: new(bytes.Buffer)}, nil, nil)
+
+	targets, err := u.targets(cx, &Upstream{Address: "unix//run/exchange/smtp.sock"})
+	if err != nil {
+		t.Fatalf("targets returned unexpected error: %v", err)
+	}
+	if len(targets) != 1 || targets[0].network != "unix" || targets[0].address != "/run/exchange/smtp.sock" {
+		t.Fatalf("unexpected unix targets: %+v", targets)
+	}
+	if targets[0].serverName != "" {
+		t.Errorf("expected no server name derived from a socket path, got %q", targets[0].serverName)
+	}
+}
@@ -0,0 +1,329 @@
+package caddystarttls
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream lookup types.
+const (
+	lookupA   = "a"
+	lookupSRV = "srv"
+	lookupMX  = "mx"
+)
+
+const (
+	// dnsMinTTL keeps records with very low TTLs from causing a query per session.
+	dnsMinTTL = 5 * time.Second
+	// dnsLookupTimeout bounds the time spent resolving a single upstream.
+	dnsLookupTimeout = 5 * time.Second
+	// dnsCacheSize caps the number of cached answers. Lookup names can come
+	// from client-controlled placeholders like {l4.tls.server_name}.
+	dnsCacheSize = 1024
+)
+
+// upstreamTarget is a concrete address to dial for an upstream, together
+// with the server name derived from it for SNI.
+type upstreamTarget struct {
+	network    string
+	address    string
+	serverName string
+}
+
+// dnsResolver resolves dynamic upstreams through a configurable set of DNS
+// servers and caches the answers for as long as their TTL allows. The cache
+// holds at most cacheSize answers, evicting the least recently used.
+type dnsResolver struct {
+	servers   []string
+	client    *dns.Client
+	cacheSize int
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // of *dnsCacheEntry
+	lru   *list.List               // most recently used first
+}
+
+type dnsCacheEntry struct {
+	key     string
+	records []dns.RR
+	expires time.Time
+}
+
+// newDNSResolver creates a resolver for the given servers. If none are
+// given, the servers from /etc/resolv.conf are used.
+func newDNSResolver(servers []string) (*dnsResolver, error) {
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("loading system resolvers: %v", err)
+		}
+		for _, s := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+
+	r := &dnsResolver{
+		client:    &dns.Client{Timeout: 2 * time.Second},
+		cacheSize: dnsCacheSize,
+		cache:     make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		r.servers = append(r.servers, s)
+	}
+	return r, nil
+}
+
+// query returns the answer records of the given type for name,
+// from the cache if the previous answer has not expired yet.
+func (r *dnsResolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	name = dns.Fqdn(name)
+	key := dns.TypeToString[qtype] + " " + strings.ToLower(name)
+
+	if records, ok := r.cached(key); ok {
+		return records, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = true
+
+	var lastErr error
+	for _, server := range r.servers {
+		resp, _, err := r.client.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+			resp, _, err = tcp.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s: %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var records []dns.RR
+		ttl := time.Hour
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			records = append(records, rr)
+			if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		if len(records) == 0 {
+			// Cache negative answers briefly as well.
+			ttl = dnsMinTTL
+		}
+		if ttl < dnsMinTTL {
+			ttl = dnsMinTTL
+		}
+
+		r.store(&dnsCacheEntry{key: key, records: records, expires: time.Now().Add(ttl)})
+		return records, nil
+	}
+	return nil, fmt.Errorf("looking up %s %s: %w", dns.TypeToString[qtype], name, lastErr)
+}
+
+// cached returns the unexpired cached answer for key. An expired answer is
+// dropped from the cache.
+func (r *dnsResolver) cached(key string) ([]dns.RR, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elem, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		r.lru.Remove(elem)
+		delete(r.cache, key)
+		return nil, false
+	}
+	r.lru.MoveToFront(elem)
+	return entry.records, true
+}
+
+// store caches an answer, evicting the least recently used answers beyond
+// the cache size.
+func (r *dnsResolver) store(entry *dnsCacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.cache[entry.key]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.cache[entry.key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.cacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// lookupHost returns the IPv6 and IPv4 addresses of host, IPv6 first as
+// RFC 8305 prefers. Both families are queried at once, and the addresses of
+// one are returned even if the query for the other fails.
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	qtypes := []uint16{dns.TypeAAAA, dns.TypeA}
+	records := make([][]dns.RR, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			records[i], errs[i] = r.query(ctx, host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []string
+	for _, answer := range records {
+		for _, rr := range answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no A/AAAA records for %s", host)
+	}
+	return ips, nil
+}
+
+// hostTargets resolves host and returns one target per address,
+// keeping host as the server name.
+func (r *dnsResolver) hostTargets(ctx context.Context, network, host, port string) ([]upstreamTarget, error) {
+	ips, err := r.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]upstreamTarget, 0, len(ips))
+	for _, ip := range ips {
+		targets = append(targets, upstreamTarget{
+			network:    network,
+			address:    net.JoinHostPort(ip, port),
+			serverName: host,
+		})
+	}
+	return targets, nil
+}
+
+// resolve expands an upstream address into the targets to dial,
+// according to the lookup type.
+func (r *dnsResolver) resolve(ctx context.Context, lookup, network, address string) ([]upstreamTarget, error) {
+	switch lookup {
+	case lookupA:
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return r.hostTargets(ctx, network, host, port)
+
+	case lookupSRV:
+		records, err := r.query(ctx, address, dns.TypeSRV)
+		if err != nil {
+			return nil, err
+		}
+		srvs := make([]*dns.SRV, 0, len(records))
+		for _, rr := range records {
+			if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." {
+				srvs = append(srvs, srv)
+			}
+		}
+		if len(srvs) == 0 {
+			return nil, fmt.Errorf("no SRV records for %s", address)
+		}
+		// Lower priority first; prefer higher weight within a priority.
+		sort.SliceStable(srvs, func(i, j int) bool {
+			if srvs[i].Priority != srvs[j].Priority {
+				return srvs[i].Priority < srvs[j].Priority
+			}
+			return srvs[i].Weight > srvs[j].Weight
+		})
+		var targets []upstreamTarget
+		for _, srv := range srvs {
+			t, err := r.hostTargets(ctx, network, strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			if err != nil {
+				continue
+			}
+			targets = append(targets, t...)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no reachable SRV targets for %s", address)
+		}
+		return targets, nil
+
+	case lookupMX:
+		domain, port, err := net.SplitHostPort(address)
+		if err != nil {
+			domain, port = address, "25"
+		}
+		records, err := r.query(ctx, domain, dns.TypeMX)
+		if err != nil {
+			return nil, err
+		}
+		mxs := make([]*dns.MX, 0, len(records))
+		for _, rr := range records {
+			if mx, ok := rr.(*dns.MX); ok {
+				mxs = append(mxs, mx)
+			}
+		}
+		sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Preference < mxs[j].Preference })
+
+		hosts := make([]string, 0, len(mxs))
+		for _, mx := range mxs {
+			hosts = append(hosts, strings.TrimSuffix(mx.Mx, "."))
+		}
+		if len(hosts) == 0 {
+			// RFC 5321 section 5.1: without MX records the domain itself is the implicit MX.
+			hosts = append(hosts, domain)
+		}
+		var targets []upstreamTarget
+		for _, host := range hosts {
+			if host == "" {
+				// Null MX (RFC 7505), the domain does not accept mail.
+				return nil, fmt.Errorf("%s does not accept mail (null MX)", domain)
+			}
+			t, err := r.hostTargets(ctx, network, host, port)
+			if err != nil {
+				continue
+			}
+			targets = append(targets, t...)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no reachable MX hosts for %s", domain)
+		}
+		return targets, nil
+	}
+	return nil, fmt.Errorf("unsupported lookup type %q", lookup)
+}
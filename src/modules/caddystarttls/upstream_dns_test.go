@@ -0,0 +1,155 @@
+package caddystarttls
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDNSServer serves a small fixed zone on a local UDP port and
+// counts the queries it receives.
+func startTestDNSServer(t *testing.T) (string, *int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	zone := map[string][]string{
+		"corp.example. MX": {
+			"corp.example. 300 IN MX 20 mx2.corp.example.",
+			"corp.example. 300 IN MX 10 mx1.corp.example.",
+		},
+		"mx1.corp.example. A":                {"mx1.corp.example. 300 IN A 10.0.0.1"},
+		"mx2.corp.example. A":                {"mx2.corp.example. 300 IN A 10.0.0.2"},
+		"dual.corp.example. A":               {"dual.corp.example. 300 IN A 10.0.0.3"},
+		"dual.corp.example. AAAA":            {"dual.corp.example. 300 IN AAAA 2001:db8::3"},
+		"broken6.corp.example. A":            {"broken6.corp.example. 300 IN A 10.0.0.4"},
+		"_submission._tcp.corp.example. SRV": {"_submission._tcp.corp.example. 300 IN SRV 0 5 587 mx1.corp.example."},
+	}
+
+	var queries int32
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name == "broken6.corp.example." && q.Qtype == dns.TypeAAAA {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		for _, rec := range zone[q.Name+" "+dns.TypeToString[q.Qtype]] {
+			rr, err := dns.NewRR(rec)
+			if err != nil {
+				t.Errorf("bad test record %q: %v", rec, err)
+				continue
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestDNSResolverMX(t *testing.T) {
+	addr, queries := startTestDNSServer(t)
+	r, err := newDNSResolver([]string{addr})
+	if err != nil {
+		t.Fatalf("newDNSResolver returned unexpected error: %v", err)
+	}
+
+	targets, err := r.resolve(context.Background(), lookupMX, "tcp", "corp.example")
+	if err != nil {
+		t.Fatalf("resolve returned unexpected error: %v", err)
+	}
+
+	expected := []upstreamTarget{
+		{network: "tcp", address: "10.0.0.1:25", serverName: "mx1.corp.example"},
+		{network: "tcp", address: "10.0.0.2:25", serverName: "mx2.corp.example"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %+v", len(expected), targets)
+	}
+	for i := range expected {
+		if targets[i] != expected[i] {
+			t.Errorf("target %d: expected %+v, got %+v", i, expected[i], targets[i])
+		}
+	}
+
+	// A second lookup within the TTL must be answered from the cache.
+	before := atomic.LoadInt32(queries)
+	if _, err := r.resolve(context.Background(), lookupMX, "tcp", "corp.example"); err != nil {
+		t.Fatalf("cached resolve returned unexpected error: %v", err)
+	}
+	if after := atomic.LoadInt32(queries); after != before {
+		t.Errorf("expected cached answers, but %d new queries were sent", after-before)
+	}
+}
+
+func TestDNSResolverSRV(t *testing.T) {
+	addr, _ := startTestDNSServer(t)
+	r, err := newDNSResolver([]string{addr})
+	if err != nil {
+		t.Fatalf("newDNSResolver returned unexpected error: %v", err)
+	}
+
+	targets, err := r.resolve(context.Background(), lookupSRV, "tcp", "_submission._tcp.corp.example")
+	if err != nil {
+		t.Fatalf("resolve returned unexpected error: %v", err)
+	}
+	if len(targets) != 1 || targets[0].address != "10.0.0.1:587" || targets[0].serverName != "mx1.corp.example" {
+		t.Errorf("unexpected SRV targets: %+v", targets)
+	}
+}
+
+func TestDNSResolverCacheEviction(t *testing.T) {
+	addr, queries := startTestDNSServer(t)
+	r, err := newDNSResolver([]string{addr})
+	if err != nil {
+		t.Fatalf("newDNSResolver returned unexpected error: %v", err)
+	}
+	r.cacheSize = 2
+	ctx := context.Background()
+	lookup := func(name string) {
+		t.Helper()
+		if _, err := r.query(ctx, name, dns.TypeA); err != nil {
+			t.Fatalf("query %s returned unexpected error: %v", name, err)
+		}
+	}
+
+	// Distinct names, as client-controlled SNIs would be, stay within the
+	// cache size.
+	for _, name := range []string{"mx1.corp.example", "mx2.corp.example", "a.corp.example", "b.corp.example"} {
+		lookup(name)
+	}
+	if len(r.cache) != 2 || r.lru.Len() != 2 {
+		t.Fatalf("expected 2 cached answers, got %d", len(r.cache))
+	}
+
+	// The least recently used answers were evicted and are queried again.
+	before := atomic.LoadInt32(queries)
+	lookup("b.corp.example")
+	if after := atomic.LoadInt32(queries); after != before {
+		t.Errorf("expected b.corp.example to be cached, but %d new queries were sent", after-before)
+	}
+	lookup("mx1.corp.example")
+	if after := atomic.LoadInt32(queries); after != before+1 {
+		t.Errorf("expected mx1.corp.example to be evicted and queried again")
+	}
+
+	// Expired answers are dropped when they are read.
+	for _, elem := range r.cache {
+		elem.Value.(*dnsCacheEntry).expires = time.Now().Add(-time.Second)
+	}
+	if _, ok := r.cached("A b.corp.example."); ok || len(r.cache) != 1 {
+		t.Errorf("expected the expired answer to be dropped, %d answers cached", len(r.cache))
+	}
+}
@@ -0,0 +1,104 @@
+package caddystarttls
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// defaultQueueTimeout is how long a session waits for a free slot
+// when queueing is enabled but no queue_timeout is configured.
+const defaultQueueTimeout = 30 * time.Second
+
+// errTooBusy is returned when a session could not get a connection slot,
+// either because the wait queue is full or because it timed out waiting.
+var errTooBusy = errors.New("too many concurrent sessions")
+
+// writeTooBusy sends a 421 reply telling the client to come back later.
+func writeTooBusy(cx *layer4.Connection) {
+	cx.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+}
+
+// tryAcquireSession reserves one of the handler-wide session slots.
+func (u *UpstreamSTARTTLS) tryAcquireSession() bool {
+	if u.MaxConns <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&u.sessions, 1) > int64(u.MaxConns) {
+		atomic.AddInt64(&u.sessions, -1)
+		return false
+	}
+	return true
+}
+
+// releaseSession frees a slot reserved with tryAcquireSession.
+func (u *UpstreamSTARTTLS) releaseSession() {
+	if u.MaxConns > 0 {
+		atomic.AddInt64(&u.sessions, -1)
+		u.notifySlotFreed()
+	}
+}
+
+// upstreamAvailable reports whether at least one upstream is below its max_conns.
+func (u *UpstreamSTARTTLS) upstreamAvailable() bool {
+	for _, up := range u.Upstreams {
+		if up.MaxConns <= 0 || atomic.LoadInt64(&up.conns) < int64(up.MaxConns) {
+			return true
+		}
+	}
+	return false
+}
+
+// slotFreed returns a channel that is closed the next time a slot is released.
+func (u *UpstreamSTARTTLS) slotFreed() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.freed == nil {
+		u.freed = make(chan struct{})
+	}
+	return u.freed
+}
+
+// notifySlotFreed wakes up all queued sessions so they can retry.
+func (u *UpstreamSTARTTLS) notifySlotFreed() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.freed != nil {
+		close(u.freed)
+		u.freed = nil
+	}
+}
+
+// waitForSlot calls try until it succeeds. While it does not, the session
+// waits in the queue until a slot is released. It fails with errTooBusy if
+// the queue is full or the deadline passes first.
+func (u *UpstreamSTARTTLS) waitForSlot(ctx context.Context, deadline time.Time, try func() bool) error {
+	if try() {
+		return nil
+	}
+	if atomic.AddInt64(&u.queued, 1) > int64(u.MaxQueue) {
+		atomic.AddInt64(&u.queued, -1)
+		return errTooBusy
+	}
+	defer atomic.AddInt64(&u.queued, -1)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		// Subscribe before retrying, so a release in between is not missed.
+		freed := u.slotFreed()
+		if try() {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-timer.C:
+			return errTooBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package caddystarttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestUpstreamSTARTTLSUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`upstream_starttls {
+		server_name mail.corp
+		upstream tcp/10.0.0.5:587 {
+			server_name ex1.corp
+			weight 3
+			max_conns 200
+		}
+		upstream tcp/10.0.0.6:587 tcp/10.0.0.7:587 {
+			insecure_skip_verify
+			backup
+		}
+		upstream tcp/10.0.0.8:587
+	}`)
+
+	var u UpstreamSTARTTLS
+	if err := u.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile returned unexpected error: %v", err)
+	}
+
+	if u.ServerName != "mail.corp" {
+		t.Errorf("expected server_name mail.corp, got %q", u.ServerName)
+	}
+	if len(u.Upstreams) != 4 {
+		t.Fatalf("expected 4 upstreams, got %d", len(u.Upstreams))
+	}
+
+	first := u.Upstreams[0]
+	if first.Address != "tcp/10.0.0.5:587" || first.ServerName != "ex1.corp" || first.Weight != 3 || first.MaxConns != 200 || first.Backup {
+		t.Errorf("unexpected first upstream: %+v", first)
+	}
+	for _, up := range u.Upstreams[1:3] {
+		if !up.InsecureSkipVerify || !up.Backup || up.ServerName != "" {
+			t.Errorf("expected block options to apply to %s, got %+v", up.Address, up)
+		}
+	}
+	if last := u.Upstreams[3]; last.Address != "tcp/10.0.0.8:587" || last.Backup || last.InsecureSkipVerify {
+		t.Errorf("unexpected last upstream: %+v", last)
+	}
+}
+
+func TestUpstreamSTARTTLSUnmarshalJSON(t *testing.T) {
+	raw := `{"upstreams": ["tcp/10.0.0.5:587", {"address": "tcp/10.0.0.6:587", "server_name": "ex2.corp", "backup": true}]}`
+
+	var u UpstreamSTARTTLS
+	if err := json.Unmarshal([]byte(raw), &u); err != nil {
+		t.Fatalf("json.Unmarshal returned unexpected error: %v", err)
+	}
+
+	if len(u.Upstreams) != 2 {
+		t.Fatalf("expected 2 upstreams, got %d", len(u.Upstreams))
+	}
+	if u.Upstreams[0].Address != "tcp/10.0.0.5:587" {
+		t.Errorf("expected legacy string upstream to be accepted, got %+v", u.Upstreams[0])
+	}
+	if up := u.Upstreams[1]; up.Address != "tcp/10.0.0.6:587" || up.ServerName != "ex2.corp" || !up.Backup {
+		t.Errorf("unexpected object upstream: %+v", up)
+	}
+}
+
+func TestUpstreamSTARTTLSCandidates(t *testing.T) {
+	u := &UpstreamSTARTTLS{
+		Upstreams: []*Upstream{
+			{Address: "a", Weight: 5},
+			{Address: "b"},
+			{Address: "c"},
+			{Address: "d", Backup: true},
+		},
+		primaries: []int{0, 1, 2},
+		backups:   []int{3},
+		logger:    zap.NewNop(),
+	}
+
+	var firstPicks []string
+	for i := 0; i < 7; i++ {
+		list := u.candidates()
+		if len(list) != 4 {
+			t.Fatalf("expected 4 candidates, got %d", len(list))
+		}
+		if list[3].Address != "d" {
+			t.Errorf("expected backup to be tried last, got %s", list[3].Address)
+		}
+		firstPicks = append(firstPicks, list[0].Address)
+	}
+	// Smooth weighted round-robin interleaves the other upstreams with the
+	// heavy one instead of sending it five sessions in a row.
+	if got := strings.Join(firstPicks, " "); got != "a a b a c a a" {
+		t.Errorf("expected first picks %q, got %q", "a a b a c a a", got)
+	}
+}
+
+func TestUpstreamMaxConns(t *testing.T) {
+	up := &Upstream{Address: "a", MaxConns: 1}
+	if !up.acquire() {
+		t.Fatal("expected first acquire to succeed")
+	}
+	if up.acquire() {
+		t.Fatal("expected second acquire to fail at max_conns")
+	}
+	up.release()
+	if !up.acquire() {
+		t.Fatal("expected acquire to succeed after release")
+	}
+}
+
+func TestParseEHLOCapabilities(t *testing.T) {
+	caps := parseEHLOCapabilities("250-mail.corp Hello\r\n250-SIZE 35882577\r\n250-AUTH=LOGIN\r\n250-AUTH PLAIN\r\n250 starttls\r\n")
+
+	if !caps.has("STARTTLS") {
+		t.Errorf("expected STARTTLS to be advertised, got %v", caps)
+	}
+	if caps.has("MAIL.CORP") {
+		t.Errorf("expected greeting line to be skipped, got %v", caps)
+	}
+	if got := strings.Join(caps["SIZE"], " "); got != "35882577" {
+		t.Errorf("expected SIZE 35882577, got %q", got)
+	}
+	if got := strings.Join(caps["AUTH"], " "); got != "LOGIN PLAIN" {
+		t.Errorf("expected AUTH LOGIN PLAIN, got %q", got)
+	}
+}
+
+// startPlaintextUpstream runs a one-shot SMTP server that does not offer STARTTLS
+// and answers every command after EHLO with "250 ok".
+func startPlaintextUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 upstream ESMTP\r\n"))
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("250-upstream\r\n250 SIZE 1024\r\n"))
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("250 ok\r\n"))
+	}()
+	return "tcp/" + ln.Addr().String()
+}
+
+func TestReadSMTPResponse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"250 ok\r\n250 next\r\n", "250 ok\r\n"},
+		{"250-mail.corp\r\n250 SIZE\r\n250 next\r\n", "250-mail.corp\r\n250 SIZE\r\n"},
+		// A final line without text (RFC 5321 section 4.2).
+		{"250\r\n250 next\r\n", "250\r\n"},
+		{"250-mail.corp\r\n250\r\n250 next\r\n", "250-mail.corp\r\n250\r\n"},
+	}
+	for _, tt := range tests {
+		got, err := readSMTPResponse(bufio.NewReader(strings.NewReader(tt.input)))
+		if err != nil {
+			t.Fatalf("readSMTPResponse(%q) returned unexpected error: %v", tt.input, err)
+		}
+		if got != tt.expected {
+			t.Errorf("readSMTPResponse(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestUpstreamSTARTTLSTLSPolicy(t *testing.T) {
+	t.Run("require fails without STARTTLS", func(t *testing.T) {
+		u := &UpstreamSTARTTLS{TLSPolicy: tlsPolicyRequire, logger: zap.NewNop()}
+		target := upstreamTarget{network: "tcp", address: strings.TrimPrefix(startPlaintextUpstream(t), "tcp/")}
+
+		_, err := u.connect(context.Background(), &Upstream{}, target)
+		if err == nil || !strings.Contains(err.Error(), "does not advertise STARTTLS") {
+			t.Fatalf("expected STARTTLS policy error, got %v", err)
+		}
+	})
+
+	t.Run("opportunistic falls back to plaintext", func(t *testing.T) {
+		u := &UpstreamSTARTTLS{
+			Upstreams: []*Upstream{{Address: startPlaintextUpstream(t)}},
+			primaries: []int{0},
+			TLSPolicy: tlsPolicyOpportunistic,
+			logger:    zap.NewNop(),
+		}
+		clientEnd, proxyEnd := net.Pipe()
+		defer clientEnd.Close()
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- u.Handle(layer4.WrapConnection(proxyEnd, nil, nil), nil)
+		}()
+
+		clientEnd.Write([]byte("NOOP\r\n"))
+		resp, err := bufio.NewReader(clientEnd).ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading proxied response: %v", err)
+		}
+		if resp != "250 ok\r\n" {
+			t.Errorf("expected proxied 250 ok, got %q", resp)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("expected plaintext session to succeed, got %v", err)
+		}
+	})
+}
+
+func TestUpstreamSTARTTLSServiceNotAvailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := "tcp/" + ln.Addr().String()
+	ln.Close()
+
+	u := &UpstreamSTARTTLS{
+		Upstreams: []*Upstream{{Address: deadAddr}},
+		primaries: []int{0},
+		logger:    zap.NewNop(),
+	}
+	mConn := &mockConn{readBuf: new(bytes.Buffer), writeBuf: new(bytes.Buffer)}
+
+	if err := u.Handle(layer4.WrapConnection(mConn, nil, nil), nil); err == nil {
+		t.Fatal("expected an error when all upstreams fail")
+	}
+	if !strings.HasPrefix(mConn.writeBuf.String(), "421 4.3.0 ") {
+		t.Errorf("expected 421 reply to the client, got %q", mConn.writeBuf.String())
+	}
+}
+
+func TestUpstreamSTARTTLSQueue(t *testing.T) {
+	t.Run("rejects with 421 when the queue is full", func(t *testing.T) {
+		up := &Upstream{Address: "tcp/127.0.0.1:1", MaxConns: 1, conns: 1}
+		u := &UpstreamSTARTTLS{
+			Upstreams:    []*Upstream{up},
+			primaries:    []int{0},
+			QueueTimeout: caddy.Duration(time.Second),
+			logger:       zap.NewNop(),
+		}
+		mConn := &mockConn{readBuf: new(bytes.Buffer), writeBuf: new(bytes.Buffer)}
+
+		err := u.Handle(layer4.WrapConnection(mConn, nil, nil), nil)
+		if !errors.Is(err, errTooBusy) {
+			t.Fatalf("expected errTooBusy, got %v", err)
+		}
+		if !strings.HasPrefix(mConn.writeBuf.String(), "421 4.7.0 ") {
+			t.Errorf("expected 421 too busy reply, got %q", mConn.writeBuf.String())
+		}
+	})
+
+	t.Run("client gone while queued is not rejected", func(t *testing.T) {
+		core, logs := observer.New(zap.WarnLevel)
+		u := &UpstreamSTARTTLS{
+			Upstreams:    []*Upstream{{Address: "tcp/127.0.0.1:1"}},
+			primaries:    []int{0},
+			MaxConns:     1,
+			MaxQueue:     1,
+			QueueTimeout: caddy.Duration(time.Minute),
+			logger:       zap.New(core),
+		}
+		if !u.tryAcquireSession() {
+			t.Fatal("expected first session slot to be free")
+		}
+		mConn := &mockConn{readBuf: new(bytes.Buffer), writeBuf: new(bytes.Buffer)}
+		cx := layer4.WrapConnection(mConn, nil, nil)
+		ctx, cancel := context.WithCancel(cx.Context)
+		cx.Context = ctx
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		if err := u.Handle(cx, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if mConn.writeBuf.Len() != 0 {
+			t.Errorf("expected no reply to the gone client, got %q", mConn.writeBuf.String())
+		}
+		if logs.Len() != 0 {
+			t.Errorf("expected no warning, got %q", logs.All()[0].Message)
+		}
+	})
+
+	t.Run("queued session proceeds once a slot is released", func(t *testing.T) {
+		u := &UpstreamSTARTTLS{MaxConns: 1, MaxQueue: 1, logger: zap.NewNop()}
+		if !u.tryAcquireSession() {
+			t.Fatal("expected first session slot to be free")
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			u.releaseSession()
+		}()
+
+		err := u.waitForSlot(context.Background(), time.Now().Add(5*time.Second), u.tryAcquireSession)
+		if err != nil {
+			t.Fatalf("expected queued session to get a slot, got %v", err)
+		}
+		if u.waitForSlot(context.Background(), time.Now().Add(50*time.Millisecond), u.tryAcquireSession) != errTooBusy {
+			t.Error("expected queue timeout while the slot is held")
+		}
+	})
+}
+
+// startSTARTTLSUpstream runs an SMTP server that offers STARTTLS and
+// answers every command on the TLS session with "250 ok".
+func startSTARTTLSUpstream(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("220 upstream ESMTP\r\n"))
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				conn.Write([]byte("250-upstream\r\n250 STARTTLS\r\n"))
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				conn.Write([]byte("220 Ready to start TLS\r\n"))
+
+				tlsConn := tls.Server(conn, serverConfig)
+				tr := bufio.NewReader(tlsConn)
+				for {
+					if _, err := tr.ReadString('\n'); err != nil {
+						return
+					}
+					tlsConn.Write([]byte("250 ok\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstreamSTARTTLSSessionResumption(t *testing.T) {
+	cert := newTestCertificate(t, "mail.corp")
+	addr := startSTARTTLSUpstream(t, cert)
+	up := &Upstream{Address: "tcp/" + addr, ServerName: "mail.corp", sessionCache: tls.NewLRUClientSessionCache(4)}
+	u := &UpstreamSTARTTLS{InsecureSkipVerify: true, logger: zap.NewNop()}
+	target := upstreamTarget{network: "tcp", address: addr}
+
+	resumedBefore := testutil.ToFloat64(upstreamTLSHandshakes.WithLabelValues(up.Address, "true"))
+	for i := 0; i < 2; i++ {
+		session, err := u.connect(context.Background(), up, target)
+		if err != nil {
+			t.Fatalf("connect %d returned unexpected error: %v", i, err)
+		}
+		// Read a response, so that the client processes the session ticket.
+		if _, err := smtpCommand(session.rw, session.reader, "NOOP"); err != nil {
+			t.Fatalf("NOOP: %v", err)
+		}
+		session.close()
+	}
+
+	if got := testutil.ToFloat64(upstreamTLSHandshakes.WithLabelValues(up.Address, "true")) - resumedBefore; got != 1 {
+		t.Errorf("expected the second handshake to resume, got %v resumed handshakes", got)
+	}
+}
+
+func TestUpstreamSTARTTLSServerName(t *testing.T) {
+	repl := caddy.NewReplacer()
+	repl.Set("l4.tls.server_name", "mx.example.com")
+	ctx := context.WithValue(context.Background(), layer4.ReplacerCtxKey, repl)
+	target := upstreamTarget{network: "tcp", address: "10.0.0.5:587", serverName: "10.0.0.5"}
+
+	tests := []struct {
+		name         string
+		handlerName  string
+		upstreamName string
+		want         string
+	}{
+		{name: "derived from target", want: "10.0.0.5"},
+		{name: "handler server_name", handlerName: "relay.corp", want: "relay.corp"},
+		{name: "upstream overrides handler", handlerName: "relay.corp", upstreamName: "ex1.corp", want: "ex1.corp"},
+		{name: "placeholder", handlerName: "{l4.tls.server_name}", want: "mx.example.com"},
+		{name: "empty placeholder falls back to target", upstreamName: "{l4.tls.unknown}", want: "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UpstreamSTARTTLS{ServerName: tt.handlerName}
+			if got := u.serverName(ctx, &Upstream{ServerName: tt.upstreamName}, target); got != tt.want {
+				t.Errorf("serverName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamSTARTTLSCleanup(t *testing.T) {
+	addr := startSTARTTLSUpstream(t, newTestCertificate(t, "mail.corp"))
+	u := &UpstreamSTARTTLS{
+		Upstreams:          []*Upstream{{Address: "tcp/" + addr}},
+		primaries:          []int{0},
+		InsecureSkipVerify: true,
+		DrainTimeout:       caddy.Duration(100 * time.Millisecond),
+		logger:             zap.NewNop(),
+	}
+
+	// An established session that never ends on its own.
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- u.Handle(layer4.WrapConnection(proxyEnd, nil, nil), nil)
+	}()
+	client := bufio.NewReader(clientEnd)
+	clientEnd.Write([]byte("NOOP\r\n"))
+	if resp, _ := client.ReadString('\n'); resp != "250 ok\r\n" {
+		t.Fatalf("expected proxied session, got %q", resp)
+	}
+
+	// Cleanup must not hold up the config reload for drain_timeout.
+	start := time.Now()
+	if err := u.Cleanup(); err != nil {
+		t.Fatalf("Cleanup returned unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected Cleanup to return right away, returned after %v", elapsed)
+	}
+	if resp, _ := client.ReadString('\n'); !strings.HasPrefix(resp, "421 4.3.2 ") {
+		t.Errorf("expected 421 at drain_timeout, got %q", resp)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the session to continue until drain_timeout, closed after %v", elapsed)
+	}
+	select {
+	case <-errc:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the session to be closed after drain_timeout")
+	}
+
+	mConn := &mockConn{readBuf: new(bytes.Buffer), writeBuf: new(bytes.Buffer)}
+	if err := u.Handle(layer4.WrapConnection(mConn, nil, nil), nil); err != nil {
+		t.Fatalf("Handle returned unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(mConn.writeBuf.String(), "421 4.3.2 ") {
+		t.Errorf("expected 421 for a session after cleanup, got %q", mConn.writeBuf.String())
+	}
+}
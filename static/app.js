@@ -1214,6 +1214,7 @@ const app = {
                         <div class="mb-2"><label for="l4_td">Upstream Domain/IPs (comma separated)</label><input type="text" id="l4_td" name="toDomain" class="form-control array-input" required></div>
                         <div class="mb-2"><label for="l4_tp">Upstream Port</label><input type="text" id="l4_tp" name="toPort" class="form-control" required></div>
                         <div class="mb-2"><input type="checkbox" name="starttls" id="l4_starttls"> <label for="l4_starttls">STARTTLS (SMTP Port 587)</label></div>
+                        <div class="mb-2"><input type="checkbox" name="starttls_check_upstreams" id="l4_starttls_check"> <label for="l4_starttls_check">Check upstreams before STARTTLS <i class="text-muted" style="font-size:0.9em;">(?) Answer 454 instead of accepting STARTTLS while no upstream is reachable. Opens a probe connection to the upstreams.</i></label></div>
                         <div class="mb-2"><input type="checkbox" name="terminateTls" id="l4_ttls"> <label for="l4_ttls">Terminate TLS</label></div>
                         <div class="mb-2"><label for="l4_cc">Custom Certificate (Terminate)</label><select id="l4_cc" name="customCert" class="form-select cert-select"></select></div>
                         <div class="mb-2"><input type="checkbox" name="acme" id="l4_acme"> <label for="l4_acme">Use Caddy-managed public ACME certificate</label> <small id="l4_acme_note" class="text-muted d-block">Uses Caddy Automatic HTTPS for Layer 4 TLS termination.</small></div>
@@ -417,12 +417,35 @@ describe('generateCaddyfile UI parity', () => {
     }, '/certs');
 
     const smtpBlock = blockFor(config, 'tcp/:587');
+    assert.match(smtpBlock, /\n\t+starttls\n/);
+    assert.doesNotMatch(smtpBlock, /check_upstream/);
     assert.match(smtpBlock, /upstream_starttls \{/);
     assert.match(smtpBlock, /upstream tcp\/10\.0\.0\.1:587 tcp\/10\.0\.0\.2:587/);
     assert.match(smtpBlock, /insecure_skip_verify/);
     assert.match(smtpBlock, /server_name smtp\.example\.com/);
   });
 
+  test('emits starttls upstream checks only when enabled', () => {
+    const config = generateCaddyfile({
+      general: { enabled: false, enable_layer4: true },
+      layer4: [{
+        id: 'smtp_checked',
+        enabled: true,
+        protocol: 'tcp',
+        fromPort: '25',
+        toDomain: ['10.0.0.1', '10.0.0.2'],
+        toPort: '25',
+        starttls: true,
+        starttls_check_upstreams: true,
+        customCert: 'smtp.pem',
+        originate_tls: 'starttls'
+      }]
+    }, '/certs');
+
+    const smtpBlock = blockFor(config, 'tcp/:25');
+    assert.match(smtpBlock, /starttls \{\n\t+check_upstream tcp\/10\.0\.0\.1:25 tcp\/10\.0\.0\.2:25\n\t+\}/);
+  });
+
   test('omits layer4 max_fails when set to zero', () => {
     const config = generateCaddyfile({
       general: { enabled: false, enable_layer4: true },